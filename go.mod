@@ -5,6 +5,7 @@ go 1.21.3
 require (
 	github.com/google/go-cmp v0.6.0
 	github.com/samber/lo v1.39.0
+	google.golang.org/protobuf v1.34.2
 )
 
 require golang.org/x/exp v0.0.0-20220303212507-bbda1eaf7a17 // indirect
@@ -1,23 +1,70 @@
 package rtq
 
 import (
+	"bufio"
 	"bytes"
+	"cmp"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"io/fs"
+	"maps"
+	"mime"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
+	gocmp "github.com/google/go-cmp/cmp"
 	"github.com/samber/lo"
 )
 
 // Have a RoundTrip queue for each specific request, and if the request matches, retrieve the RoundTrip from the queue and execute it.
 type MockTransport struct {
-	queues      []*RoundTripQueue
-	requestLogs []requestLog
-	mu          sync.Mutex
+	queues       []*RoundTripQueue
+	requestLogs  []requestLog
+	defaultDelay time.Duration
+	decorate     func(*http.Request, *http.Response) *http.Response
+	normalize    func(string) string
+	verbose      io.Writer
+	maxRequests  int
+	passthrough  http.RoundTripper
+	hashed       map[RequestHash]func(*http.Request) (*http.Response, error)
+	store        map[string]any
+	// capture is set by EnableResponseCapture; lastBody and served are only recorded while it is set.
+	capture  bool
+	lastBody *bodyRecorder
+	served   []servedResponse
+	// resumed is non-nil while paused and is closed by Resume.
+	resumed      chan struct{}
+	unmatched    chan *http.Request
+	closed       bool
+	inFlight     atomic.Int64
+	peakInFlight atomic.Int64
+	mu           sync.Mutex
 }
 
 var _ http.RoundTripper = (*MockTransport)(nil)
@@ -29,217 +76,3109 @@ func NewTransport(queues ...RoundTripQueue) *MockTransport {
 }
 
 func (m *MockTransport) RoundTrip(req *http.Request) (*http.Response, error) {
-	roundTrip, err := m.dequeue(req)
+	m.enter()
+	defer m.inFlight.Add(-1)
+
+	// Note the time on entry so that WithinTimeWindow and the request log see when the request was made
+	at := time.Now()
+	if err := m.waitResumed(req.Context()); err != nil {
+		return nil, err
+	}
+	roundTrip, err := m.dequeue(req, at)
 	if err != nil {
 		return nil, err
 	}
-	return roundTrip(req)
+	m.mu.Lock()
+	delay, decorate := m.defaultDelay, m.decorate
+	m.mu.Unlock()
+	if err := sleepContext(req.Context(), delay); err != nil {
+		return nil, err
+	}
+	res, err := serveWithContext(roundTrip, req, context.WithValue(req.Context(), transportContextKey{}, m))
+	if err != nil || res == nil {
+		return res, err
+	}
+	if decorate != nil {
+		res = decorate(req, res)
+	}
+	if res == nil {
+		return nil, nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.capture {
+		return res, nil
+	}
+	// Tee the body so that LastResponseBody and ServedResponses see exactly what the client reads.
+	// http.NoBody and writable bodies, e.g. of 101 Switching Protocols responses, are left as is.
+	recorder := &bodyRecorder{}
+	_, writable := res.Body.(io.ReadWriteCloser)
+	if res.Body != nil && res.Body != http.NoBody && !writable {
+		res.Body = teeReadCloser{Reader: io.TeeReader(res.Body, recorder), Closer: res.Body}
+		m.lastBody = recorder
+	}
+	snapshot := *res
+	snapshot.Header = res.Header.Clone()
+	m.served = append(m.served, servedResponse{response: &snapshot, body: recorder})
+	return res, nil
+}
+
+// servedResponse is a response served by the transport with the body bytes the client has read from it.
+type servedResponse struct {
+	response *http.Response
+	body     *bodyRecorder
 }
 
-func (m *MockTransport) dequeue(req *http.Request) (func(*http.Request) (*http.Response, error), error) {
+// EnableResponseCapture makes the transport keep every response it serves from now on, with a copy of the body
+// bytes the client reads, for ServedResponses, AssertServedBody and LastResponseBody. Captured responses are held
+// for the lifetime of the transport, so leave it disabled for long-running or load-generating uses.
+func (m *MockTransport) EnableResponseCapture() {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	m.capture = true
+}
 
-	// Find a queue matching the request
-	q, found, err := m.find(req)
+// ServedResponses returns copies of the responses served so far, in order, with bodies holding the bytes
+// the client has read from them. Read response bodies to the end before calling it to capture them fully.
+// Failed round trips are not included. Responses are only captured after EnableResponseCapture.
+func (m *MockTransport) ServedResponses() []*http.Response {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return lo.Map(m.served, func(s servedResponse, _ int) *http.Response {
+		copied := *s.response
+		copied.Header = s.response.Header.Clone()
+		copied.Body = io.NopCloser(bytes.NewReader(s.body.Bytes()))
+		return &copied
+	})
+}
+
+// Replay rebuilds queues serving responses recorded with ServedResponses. Each response is served once
+// to a request with the same origin, method, path and query as its Request, so responses without a Request are skipped.
+func Replay(responses []*http.Response) []RoundTripQueue {
+	return lo.FilterMap(responses, func(res *http.Response, _ int) (RoundTripQueue, bool) {
+		if res.Request == nil {
+			return RoundTripQueue{}, false
+		}
+		u := res.Request.URL
+		rawQuery := u.RawQuery
+		q := New(u.Scheme + "://" + u.Host).
+			method(res.Request.Method).
+			path(u.Path).
+			Matcher(func(req *http.Request) (bool, error) {
+				return req.URL.RawQuery == rawQuery, nil
+			})
+		// Serve the replayed response with the incoming request rather than the recorded one
+		recorded := *res
+		recorded.Request = nil
+		q.roundTripFuncs = append(q.roundTripFuncs, replayable(&recorded))
+		return q, true
+	})
+}
+
+// Recorder is a RoundTripper that forwards requests to a real transport and records each interaction,
+// writing them to a JSON cassette file on Close. Load the cassette with LoadCassette to replay it.
+// The values of credential headers are redacted in the cassette; see SetRedactedHeaders.
+type Recorder struct {
+	rt           http.RoundTripper
+	path         string
+	redacted     []string
+	interactions []cassetteInteraction
+	mu           sync.Mutex
+}
+
+var _ http.RoundTripper = (*Recorder)(nil)
+
+// defaultRedactedHeaders are the headers whose values a Recorder redacts unless SetRedactedHeaders is called.
+var defaultRedactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// redactedValue replaces the values of redacted headers in a cassette.
+const redactedValue = "REDACTED"
+
+// NewRecorder returns a Recorder forwarding to rt, or http.DefaultTransport if rt is nil, and writing to path.
+func NewRecorder(path string, rt http.RoundTripper) *Recorder {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return &Recorder{rt: rt, path: path, redacted: defaultRedactedHeaders}
+}
+
+// SetRedactedHeaders sets the request and response headers whose values are recorded as "REDACTED",
+// replacing the default Authorization, Proxy-Authorization, Cookie and Set-Cookie. Pass none to record every value.
+func (r *Recorder) SetRedactedHeaders(keys ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.redacted = keys
+}
+
+// RoundTrip forwards a copy of req with its body buffered for recording, so req itself is left as is
+// apart from its body being read and closed, as for any RoundTripper.
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	var reqBody []byte
+	if req.Body != nil {
+		var err error
+		reqBody, err = io.ReadAll(req.Body)
+		_ = req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	forwarded := req.Clone(req.Context())
+	if req.Body != nil {
+		forwarded.Body = io.NopCloser(bytes.NewReader(reqBody))
+	}
+	res, err := r.rt.RoundTrip(forwarded)
 	if err != nil {
 		return nil, err
 	}
-	if !found {
-		m.requestLogs = append(m.requestLogs, requestLog{matched: false, request: req})
-		return nil, errors.New("mock is not registered")
+	if res.Request == forwarded {
+		res.Request = req
 	}
-	m.requestLogs = append(m.requestLogs, requestLog{matched: true, request: req})
-	// Retrieve the roundTrip from the queue and execute it
-	// In the find method, queues with len(roundTripFuncs) of 0 are not matched, so it is guaranteed that len(roundTripFuncs) is 1 or more.
-	roundTrip := q.roundTripFuncs[0]
-	q.roundTripFuncs = q.roundTripFuncs[1:]
+	resBody, err := io.ReadAll(res.Body)
+	_ = res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	res.Body = io.NopCloser(bytes.NewReader(resBody))
 
-	return roundTrip, nil
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.interactions = append(r.interactions, cassetteInteraction{
+		Request: cassetteRequest{
+			Method:  req.Method,
+			URL:     req.URL.String(),
+			Headers: redactHeaders(req.Header, r.redacted),
+			Body:    newCassetteBody(reqBody),
+		},
+		Response: cassetteResponse{
+			Status:  res.StatusCode,
+			Headers: redactHeaders(res.Header, r.redacted),
+			Body:    newCassetteBody(resBody),
+		},
+	})
+	return res, nil
 }
 
-// Find a queue that matches the passed request
-func (m *MockTransport) find(req *http.Request) (*RoundTripQueue, bool, error) {
-	for _, q := range m.queues {
-		// If roundTripFuncs is empty, it is treated as no match and the next matching queue is searched.
-		if len(q.roundTripFuncs) != 0 {
-			m, err := q.match(req)
-			if err != nil {
-				return nil, false, err
-			}
-			if m {
-				return q, true, nil
-			}
+// redactHeaders returns a copy of header with the values of keys replaced by redactedValue.
+func redactHeaders(header http.Header, keys []string) http.Header {
+	redacted := header.Clone()
+	for _, key := range keys {
+		if values := redacted.Values(key); len(values) != 0 {
+			redacted[http.CanonicalHeaderKey(key)] = lo.Map(values, func(string, int) string { return redactedValue })
 		}
 	}
+	return redacted
+}
 
-	return nil, false, nil
+// Close writes the recorded interactions to the cassette file.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b, err := json.MarshalIndent(cassette{Interactions: r.interactions}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(r.path, b, 0o644)
 }
 
-func (m *MockTransport) unmatchRequests() []*http.Request {
-	return lo.FilterMap(m.requestLogs, func(l requestLog, _ int) (*http.Request, bool) {
-		return l.request, !l.matched
-	})
+// LoadCassette returns a transport replaying the interactions recorded by a Recorder in the cassette at path.
+// Each recorded response is served once to a request with the same origin, method, path, query and body as
+// the recorded request, so requests to the same URL with different payloads get their own responses.
+// Recorded request headers are not matched.
+func LoadCassette(path string) (*MockTransport, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c cassette
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("invalid cassette %s: %w", path, err)
+	}
+	responses := make([]*http.Response, 0, len(c.Interactions))
+	bodies := make([]string, 0, len(c.Interactions))
+	for i, interaction := range c.Interactions {
+		reqBody, err := interaction.Request.Body.decode()
+		if err != nil {
+			return nil, fmt.Errorf("invalid cassette %s: interaction %d: %w", path, i, err)
+		}
+		req, err := http.NewRequest(interaction.Request.Method, interaction.Request.URL, bytes.NewReader(reqBody))
+		if err != nil {
+			return nil, fmt.Errorf("invalid cassette %s: interaction %d: %w", path, i, err)
+		}
+		req.Header = interaction.Request.Headers
+		bodies = append(bodies, string(reqBody))
+		resBody, err := interaction.Response.Body.decode()
+		if err != nil {
+			return nil, fmt.Errorf("invalid cassette %s: interaction %d: %w", path, i, err)
+		}
+		responses = append(responses, &http.Response{
+			Status:     fmt.Sprintf("%d %s", interaction.Response.Status, http.StatusText(interaction.Response.Status)),
+			StatusCode: interaction.Response.Status,
+			Header:     interaction.Response.Headers,
+			Body:       io.NopCloser(bytes.NewReader(resBody)),
+			Request:    req,
+		})
+	}
+	// Every response has a Request, so Replay returns a queue per interaction in order
+	queues := Replay(responses)
+	for i := range queues {
+		queues[i] = queues[i].BodyString(bodies[i])
+	}
+	return NewTransport(queues...), nil
 }
 
-func (m *MockTransport) Completed() bool {
-	remaining := lo.SumBy(
-		m.queues,
-		func(q *RoundTripQueue) int { return len(q.roundTripFuncs) },
-	)
-	return remaining == 0 && len(m.unmatchRequests()) == 0
+type cassette struct {
+	Interactions []cassetteInteraction `json:"interactions"`
 }
 
-func (m *MockTransport) RequestLogString() string {
-	return strings.Join(
-		lo.Map(m.requestLogs, func(l requestLog, i int) string { return fmt.Sprintf("%d: %s", i+1, l.String()) }),
-		"\n",
-	)
+type cassetteInteraction struct {
+	Request  cassetteRequest  `json:"request"`
+	Response cassetteResponse `json:"response"`
 }
 
-type MatchFunc func(*http.Request) (bool, error)
+type cassetteRequest struct {
+	Method  string       `json:"method"`
+	URL     string       `json:"url"`
+	Headers http.Header  `json:"headers,omitempty"`
+	Body    cassetteBody `json:"body"`
+}
 
-// roundTrip queue
-type RoundTripQueue struct {
-	matchFuncs     []MatchFunc
-	roundTripFuncs []func(*http.Request) (*http.Response, error)
+type cassetteResponse struct {
+	Status  int          `json:"status"`
+	Headers http.Header  `json:"headers,omitempty"`
+	Body    cassetteBody `json:"body"`
 }
 
-func New(origin string) RoundTripQueue {
-	matchFuncs := []MatchFunc{
-		func(req *http.Request) (bool, error) {
-			return req.URL.Scheme+"://"+req.URL.Host == origin, nil
-		},
+// cassetteBody holds a body as text, or base64-encoded with Encoding "base64" if it is not valid UTF-8.
+type cassetteBody struct {
+	Encoding string `json:"encoding,omitempty"`
+	Data     string `json:"data"`
+}
+
+func newCassetteBody(b []byte) cassetteBody {
+	if utf8.Valid(b) {
+		return cassetteBody{Data: string(b)}
 	}
-	return RoundTripQueue{
-		matchFuncs:     matchFuncs,
-		roundTripFuncs: make([]func(*http.Request) (*http.Response, error), 0),
+	return cassetteBody{Encoding: "base64", Data: base64.StdEncoding.EncodeToString(b)}
+}
+
+func (b cassetteBody) decode() ([]byte, error) {
+	switch b.Encoding {
+	case "":
+		return []byte(b.Data), nil
+	case "base64":
+		return base64.StdEncoding.DecodeString(b.Data)
+	default:
+		return nil, fmt.Errorf("unsupported body encoding %q", b.Encoding)
 	}
 }
 
-func (q RoundTripQueue) match(req *http.Request) (bool, error) {
-	for _, f := range q.matchFuncs {
-		m, err := f(req)
-		if err != nil {
-			return false, err
-		}
-		if !m {
-			return false, nil
+// LastResponseBody returns the body bytes of the most recently served response that the client has read so far.
+// It returns nil if no response with a body has been served since EnableResponseCapture.
+func (m *MockTransport) LastResponseBody() []byte {
+	m.mu.Lock()
+	recorder := m.lastBody
+	m.mu.Unlock()
+	if recorder == nil {
+		return nil
+	}
+	return recorder.Bytes()
+}
+
+// enter counts a request in flight and records the peak.
+func (m *MockTransport) enter() {
+	n := m.inFlight.Add(1)
+	for {
+		peak := m.peakInFlight.Load()
+		if n <= peak || m.peakInFlight.CompareAndSwap(peak, n) {
+			return
 		}
 	}
-	return true, nil
 }
 
-func (q RoundTripQueue) Header(key, value string) RoundTripQueue {
-	q.matchFuncs = append(q.matchFuncs, func(req *http.Request) (bool, error) {
-		return req.Header.Get(key) == value, nil
-	})
-	return q
+// MaxConcurrency returns the largest number of RoundTrip calls observed in flight at the same time.
+func (m *MockTransport) MaxConcurrency() int {
+	return int(m.peakInFlight.Load())
 }
 
-func (q RoundTripQueue) method(method string) RoundTripQueue {
-	q.matchFuncs = append(q.matchFuncs, func(req *http.Request) (bool, error) {
-		return req.Method == method, nil
-	})
-	return q
+type transportContextKey struct{}
+
+// serveWithContext calls serve with a copy of req carrying ctx. A response whose Request is that copy gets req back,
+// so that callers see their own request as the default Request of the response.
+func serveWithContext(serve func(*http.Request) (*http.Response, error), req *http.Request, ctx context.Context) (*http.Response, error) {
+	derived := req.WithContext(ctx)
+	res, err := serve(derived)
+	if res != nil && res.Request == derived {
+		res.Request = req
+	}
+	return res, err
 }
 
-func (q RoundTripQueue) path(path string) RoundTripQueue {
-	q.matchFuncs = append(q.matchFuncs, func(req *http.Request) (bool, error) {
-		return req.URL.Path == path, nil
-	})
-	return q
+// Store is a key-value store shared by all queues of a transport, guarded by the transport mutex.
+type Store struct {
+	m *MockTransport
 }
 
-func (q RoundTripQueue) Get(path string) RoundTripQueue {
-	return q.method(http.MethodGet).path(path)
+// Store returns the transport's store, e.g. to seed it before a test or inspect it afterwards.
+func (m *MockTransport) Store() *Store {
+	return &Store{m: m}
 }
 
-func (q RoundTripQueue) Post(path string) RoundTripQueue {
-	return q.method(http.MethodPost).path(path)
+// StoreFrom returns the store of the transport serving req, for use inside response funcs.
+// It returns nil if req was not passed through a MockTransport.
+func StoreFrom(req *http.Request) *Store {
+	m, ok := req.Context().Value(transportContextKey{}).(*MockTransport)
+	if !ok {
+		return nil
+	}
+	return m.Store()
 }
 
-func (q RoundTripQueue) Put(path string) RoundTripQueue {
-	return q.method(http.MethodPut).path(path)
+func (s *Store) Get(key string) (any, bool) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	v, ok := s.m.store[key]
+	return v, ok
 }
 
-func (q RoundTripQueue) Delete(path string) RoundTripQueue {
-	return q.method(http.MethodDelete).path(path)
+func (s *Store) Set(key string, value any) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	if s.m.store == nil {
+		s.m.store = map[string]any{}
+	}
+	s.m.store[key] = value
 }
 
-func (q RoundTripQueue) Query(key, value string) RoundTripQueue {
-	q.matchFuncs = append(q.matchFuncs, func(req *http.Request) (bool, error) {
-		return req.URL.Query().Get(key) == value, nil
+// Fork returns an independent copy of the transport with the same queues, store and settings, such as the default
+// delay, response decorator, body normalizer, verbose writer, max requests and passthrough, and an empty request log.
+// Consuming responses in the fork does not affect the parent and vice versa.
+func (m *MockTransport) Fork() *MockTransport {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return &MockTransport{
+		queues:       lo.Map(m.queues, func(q *RoundTripQueue, _ int) *RoundTripQueue { return q.clone() }),
+		defaultDelay: m.defaultDelay,
+		decorate:     m.decorate,
+		normalize:    m.normalize,
+		verbose:      m.verbose,
+		maxRequests:  m.maxRequests,
+		passthrough:  m.passthrough,
+		hashed:       maps.Clone(m.hashed),
+		store:        maps.Clone(m.store),
+	}
+}
+
+// RequestHash identifies a request independently of the order in which mocks are registered.
+type RequestHash string
+
+// HashRequest returns the hex-encoded SHA-256 of the normalized request
+// "METHOD\nPATH\nQUERY\nBODY", where METHOD is upper-cased and QUERY is url.Values.Encode of
+// the request query (sorted by key, values in the order sent). The body is restored after reading.
+func HashRequest(req *http.Request) (RequestHash, error) {
+	body, err := peekBody(req)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%s\n", strings.ToUpper(req.Method), req.URL.Path, req.URL.Query().Encode())
+	h.Write(body)
+	return RequestHash(hex.EncodeToString(h.Sum(nil))), nil
+}
+
+// SetMock registers responses keyed by HashRequest. Requests whose hash is registered are served
+// before any queue is consulted. Hashed responses are not consumed, so their bodies are captured up front.
+func (m *MockTransport) SetMock(responses map[RequestHash]*http.Response) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.hashed = lo.MapValues(responses, func(res *http.Response, _ RequestHash) func(*http.Request) (*http.Response, error) {
+		return replayable(res)
 	})
-	return q
 }
 
-func (q RoundTripQueue) BodyString(body string) RoundTripQueue {
-	q.matchFuncs = append(q.matchFuncs, func(req *http.Request) (bool, error) {
-		got, err := io.ReadAll(req.Body)
-		if err != nil {
-			return false, err
+// SetResponseDecorator sets fn to be applied to every response served by the transport, e.g. to add a header.
+// fn runs after the queue's response func has built the response, so it sees and may override anything set there.
+// It is not called when the round trip fails.
+func (m *MockTransport) SetResponseDecorator(fn func(*http.Request, *http.Response) *http.Response) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.decorate = fn
+}
+
+// unmatchedBuffer is the capacity of the channel returned by UnmatchedChan.
+const unmatchedBuffer = 64
+
+// UnmatchedChan returns a channel receiving each unmatched request as it happens. The channel is buffered
+// with capacity 64 so that RoundTrip never blocks on it; unmatched requests that do not fit are dropped
+// from the channel but remain in the request log. The channel is closed by Close.
+func (m *MockTransport) UnmatchedChan() <-chan *http.Request {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.unmatched == nil {
+		m.unmatched = make(chan *http.Request, unmatchedBuffer)
+		if m.closed {
+			close(m.unmatched)
 		}
-		req.Body = io.NopCloser(bytes.NewReader(got))
-		return string(got) == body, nil
-	})
-	return q
+	}
+	return m.unmatched
 }
 
-func (q RoundTripQueue) Matcher(matchFunc MatchFunc) RoundTripQueue {
-	q.matchFuncs = append(q.matchFuncs, matchFunc)
-	return q
+// notifyUnmatched sends req to the UnmatchedChan without blocking. The caller must hold m.mu.
+func (m *MockTransport) notifyUnmatched(req *http.Request) {
+	if m.unmatched == nil || m.closed {
+		return
+	}
+	select {
+	case m.unmatched <- req:
+	default:
+	}
 }
 
-func (q RoundTripQueue) ResponseSimple(statusCode int, body string) RoundTripQueue {
-	q.roundTripFuncs = append(q.roundTripFuncs, func(req *http.Request) (*http.Response, error) {
-		return &http.Response{
-			StatusCode: statusCode,
-			Body:       io.NopCloser(strings.NewReader(body)),
-			Request:    req,
-		}, nil
-	})
-	return q
+// Close tears down the transport, closing the channel returned by UnmatchedChan.
+// Requests can still be served after Close.
+func (m *MockTransport) Close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return
+	}
+	m.closed = true
+	if m.unmatched != nil {
+		close(m.unmatched)
+	}
 }
 
-func (q RoundTripQueue) ResponseJSON(statusCode int, body any) RoundTripQueue {
-	b, err := json.Marshal(body)
-	if err != nil {
-		panic(err)
+// WithPassthrough forwards requests that match no queue to rt, or http.DefaultTransport if rt is nil,
+// instead of failing with "mock is not registered". Forwarded requests are logged as "(passthrough)"
+// and are not counted as unmatched by Completed and UnmatchedRequests.
+func (m *MockTransport) WithPassthrough(rt http.RoundTripper) *MockTransport {
+	if rt == nil {
+		rt = http.DefaultTransport
 	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.passthrough = rt
+	return m
+}
 
-	q.roundTripFuncs = append(q.roundTripFuncs, func(req *http.Request) (*http.Response, error) {
-		return &http.Response{
-			StatusCode: statusCode,
-			Body:       io.NopCloser(bytes.NewBuffer(b)),
-			Header:     http.Header{"Content-Type": []string{"application/json"}},
-			Request:    req,
-		}, nil
-	})
-	return q
+// SetMaxRequests caps the number of requests the transport accepts, as a guard against runaway retry loops.
+// Once n requests have been received, matched or not, RoundTrip fails with "exceeded max requests (n)"
+// without logging the request. n <= 0 removes the cap.
+func (m *MockTransport) SetMaxRequests(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.maxRequests = n
 }
 
-func (q RoundTripQueue) Response(res *http.Response) RoundTripQueue {
-	q.roundTripFuncs = append(q.roundTripFuncs, func(req *http.Request) (*http.Response, error) {
-		return res, nil
-	})
-	return q
+// SetVerbose makes the transport write every matching decision to w: for each request, the result of each
+// evaluated matcher per queue and the queue that served it. Matchers are labeled by the method that added them,
+// e.g. "Header" or "path"; matchers added with Matcher are labeled by their function name. Pass nil to disable.
+func (m *MockTransport) SetVerbose(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.verbose = w
 }
 
-func (q RoundTripQueue) ResponseFunc(roundTrip func(*http.Request) (*http.Response, error)) RoundTripQueue {
-	q.roundTripFuncs = append(q.roundTripFuncs, roundTrip)
-	return q
+// NormalizeResponseBodies trims trailing whitespace from the bodies of string-based responses,
+// e.g. ones loaded from indented fixture files. See SetBodyNormalizer for the responses affected.
+func (m *MockTransport) NormalizeResponseBodies() {
+	m.SetBodyNormalizer(func(body string) string { return strings.TrimRightFunc(body, unicode.IsSpace) })
 }
 
-type requestLog struct {
-	matched bool
-	request *http.Request
+// SetBodyNormalizer sets fn to rewrite the bodies of the responses built from a body string before serving:
+// ResponseSimple, ResponseCloseError, ResponseSmallReads, ResponseAutoCompress, ResponseRawHeaders,
+// ResponseHeaderDelay, ResponseByLanguage, IdempotentResponse, AlwaysResponseSimple, ResponseAlternateBody and
+// ResponseVaried. Other responses are served as is.
+func (m *MockTransport) SetBodyNormalizer(fn func(string) string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.normalize = fn
 }
 
-func (l requestLog) String() string {
-	s := fmt.Sprintf("%s %s", l.request.Method, l.request.URL.String())
-	if !l.matched {
-		s += " (not matched)"
+// normalizeBody applies the body normalizer of the transport serving req, if any.
+func normalizeBody(req *http.Request, body string) string {
+	m, ok := req.Context().Value(transportContextKey{}).(*MockTransport)
+	if !ok {
+		return body
 	}
-	return s
+	m.mu.Lock()
+	normalize := m.normalize
+	m.mu.Unlock()
+	if normalize == nil {
+		return body
+	}
+	return normalize(body)
+}
+
+// Pause makes RoundTrip block until Resume is called or the request context is done.
+// Requests already past the pause point are not affected.
+func (m *MockTransport) Pause() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.resumed == nil {
+		m.resumed = make(chan struct{})
+	}
+}
+
+// Resume releases the requests blocked by Pause.
+func (m *MockTransport) Resume() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.resumed != nil {
+		close(m.resumed)
+		m.resumed = nil
+	}
+}
+
+func (m *MockTransport) waitResumed(ctx context.Context) error {
+	m.mu.Lock()
+	resumed := m.resumed
+	m.mu.Unlock()
+	if resumed == nil {
+		return nil
+	}
+	select {
+	case <-resumed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SetDefaultDelay sets a delay applied to every request the transport serves before its response func runs,
+// including responses registered with SetMock and requests forwarded by WithPassthrough. Unmatched requests fail
+// without delay. Delays of individual responses (e.g. ResponseDelayError) are added on top of it.
+func (m *MockTransport) SetDefaultDelay(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.defaultDelay = d
+}
+
+func (m *MockTransport) dequeue(req *http.Request, at time.Time) (func(*http.Request) (*http.Response, error), error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.maxRequests > 0 && len(m.requestLogs) >= m.maxRequests {
+		return nil, fmt.Errorf("exceeded max requests (%d)", m.maxRequests)
+	}
+
+	// Responses registered by request hash take precedence over queues
+	if len(m.hashed) != 0 {
+		hash, err := HashRequest(req)
+		if err != nil {
+			return nil, err
+		}
+		if roundTrip, ok := m.hashed[hash]; ok {
+			m.requestLogs = append(m.requestLogs, requestLog{matched: true, queueIndex: -1, request: req, at: at})
+			return roundTrip, nil
+		}
+	}
+
+	// Find a queue matching the request
+	i, found, err := m.find(req, at)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		if m.passthrough != nil {
+			m.requestLogs = append(m.requestLogs, requestLog{passthrough: true, queueIndex: -1, request: req, at: at})
+			return m.passthrough.RoundTrip, nil
+		}
+		m.requestLogs = append(m.requestLogs, requestLog{matched: false, queueIndex: -1, request: req, at: at})
+		m.notifyUnmatched(req)
+		return nil, errors.New("mock is not registered")
+	}
+	m.requestLogs = append(m.requestLogs, requestLog{matched: true, queueIndex: i, queueName: m.queues[i].name, request: req, at: at})
+	// Retrieve the roundTrip from the queue and execute it
+	// In the find method, queues without servable roundTrips are not matched, so it is guaranteed that next returns one.
+	q := m.queues[i]
+	roundTrip := q.next()
+	if q.route != nil {
+		params, _ := q.route.match(req.URL.Path)
+		serve := roundTrip
+		roundTrip = func(req *http.Request) (*http.Response, error) {
+			return serveWithContext(serve, req, context.WithValue(req.Context(), pathParamsContextKey{}, params))
+		}
+	}
+	if q.delayFunc != nil {
+		delayFunc, serve := q.delayFunc, roundTrip
+		roundTrip = func(req *http.Request) (*http.Response, error) {
+			if err := sleepContext(req.Context(), delayFunc(req)); err != nil {
+				return nil, err
+			}
+			return serve(req)
+		}
+	}
+	return roundTrip, nil
+}
+
+// Find the index of a queue that matches the passed request
+func (m *MockTransport) find(req *http.Request, at time.Time) (int, bool, error) {
+	if m.verbose != nil {
+		fmt.Fprintf(m.verbose, "%s %s\n", req.Method, req.URL.String())
+	}
+	for i, q := range m.queues {
+		// If there is nothing to serve, it is treated as no match and the next matching queue is searched.
+		if !q.servable() {
+			if m.verbose != nil {
+				fmt.Fprintf(m.verbose, "  queue %d: nothing to serve\n", i)
+			}
+			continue
+		}
+		matched, err := q.matchVerbose(req, at, m.verbose, i)
+		if err != nil {
+			return 0, false, err
+		}
+		if matched {
+			if m.verbose != nil {
+				fmt.Fprintf(m.verbose, "  => queue %d\n", i)
+			}
+			return i, true, nil
+		}
+	}
+
+	if m.verbose != nil {
+		fmt.Fprintf(m.verbose, "  => not matched\n")
+	}
+	return 0, false, nil
+}
+
+func (m *MockTransport) unmatchRequests() []*http.Request {
+	return lo.FilterMap(m.requestLogs, func(l requestLog, _ int) (*http.Request, bool) {
+		return l.request, !l.matched && !l.passthrough
+	})
+}
+
+// UnmatchedRequests returns the requests that matched no queue, in the order they were received.
+func (m *MockTransport) UnmatchedRequests() []*http.Request {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.unmatchRequests()
+}
+
+// Completed reports whether every queued response has been served and no request went unmatched.
+// Ring responses, such as ResponseRing and Fallback, and queues detached by DetachAfter are not counted;
+// DrainRemaining likewise leaves ring responses in place.
+func (m *MockTransport) Completed() bool {
+	remaining := lo.SumBy(
+		m.queues,
+		func(q *RoundTripQueue) int {
+			if q.detached() {
+				return 0
+			}
+			return len(q.roundTripFuncs)
+		},
+	)
+	return remaining == 0 && len(m.unmatchRequests()) == 0
+}
+
+// RemainingFor returns the number of responses left in the queues labeled name with Name.
+// Ring responses and queues detached by DetachAfter are not counted, as in Completed.
+func (m *MockTransport) RemainingFor(name string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return lo.SumBy(m.queues, func(q *RoundTripQueue) int {
+		if q.name != name || q.detached() {
+			return 0
+		}
+		return len(q.roundTripFuncs)
+	})
+}
+
+// DrainRemaining invokes every remaining response func and returns the results, emptying the queues.
+// As in Completed, ring responses such as ResponseRing and Fallback are skipped and stay in place.
+// Each func is called with a synthetic request "GET http://rtq.invalid/" with an empty body. The request is not
+// passed through the transport, so funcs that need it, such as ResponseStore, fail. The funcs run without holding
+// the transport lock, and the body of each response is read into memory and closed.
+// A response func that returns an error, or whose body fails to read, yields a nil entry in the result.
+func (m *MockTransport) DrainRemaining() []*http.Response {
+	m.mu.Lock()
+	var roundTrips []func(*http.Request) (*http.Response, error)
+	for _, q := range m.queues {
+		roundTrips = append(roundTrips, q.roundTripFuncs...)
+		q.roundTripFuncs = nil
+	}
+	m.mu.Unlock()
+
+	return lo.Map(roundTrips, func(roundTrip func(*http.Request) (*http.Response, error), _ int) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, "http://rtq.invalid/", http.NoBody)
+		if err != nil {
+			panic(err)
+		}
+		res, err := roundTrip(req)
+		if err != nil || res == nil {
+			return nil
+		}
+		if res.Body == nil {
+			return res
+		}
+		body, err := io.ReadAll(res.Body)
+		_ = res.Body.Close()
+		if err != nil {
+			return nil
+		}
+		res.Body = io.NopCloser(bytes.NewReader(body))
+		return res
+	})
+}
+
+// RequestLogEntry describes a request received by the transport.
+// QueueIndex is the index of the queue (in NewTransport order) that served the request, or -1 if it was not matched or was served by SetMock.
+// QueueName is the label given to that queue with Name, if any. Time is when RoundTrip received the request.
+// Passthrough is set for unmatched requests forwarded by WithPassthrough.
+type RequestLogEntry struct {
+	Request     *http.Request
+	Matched     bool
+	Passthrough bool
+	QueueIndex  int
+	QueueName   string
+	Time        time.Time
+}
+
+func (m *MockTransport) RequestLogEntries() []RequestLogEntry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return lo.Map(m.requestLogs, func(l requestLog, _ int) RequestLogEntry {
+		return RequestLogEntry{Request: l.request, Matched: l.matched, Passthrough: l.passthrough, QueueIndex: l.queueIndex, QueueName: l.queueName, Time: l.at}
+	})
+}
+
+// Tree renders the registered queues grouped by origin, with their matcher and remaining response counts.
+func (m *MockTransport) Tree() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var origins []string
+	byOrigin := map[string][]string{}
+	for i, q := range m.queues {
+		if _, ok := byOrigin[q.origin]; !ok {
+			origins = append(origins, q.origin)
+		}
+		line := fmt.Sprintf("  queue %d: matchers=%d remaining=%d", i, len(q.matchFuncs), len(q.roundTripFuncs))
+		if len(q.ringFuncs) != 0 {
+			line += fmt.Sprintf(" ring=%d", len(q.ringFuncs))
+		}
+		byOrigin[q.origin] = append(byOrigin[q.origin], line)
+	}
+	var b strings.Builder
+	for _, origin := range origins {
+		b.WriteString(origin + "\n")
+		for _, line := range byOrigin[origin] {
+			b.WriteString(line + "\n")
+		}
+	}
+	return b.String()
+}
+
+func (m *MockTransport) RequestLogString() string {
+	return strings.Join(
+		lo.Map(m.requestLogs, func(l requestLog, i int) string { return fmt.Sprintf("%d: %s", i+1, l.String()) }),
+		"\n",
+	)
+}
+
+// AssertCompleted reports an error on t unless the transport is Completed and every queue with ExpectCalls
+// matched exactly the expected number of requests.
+func (m *MockTransport) AssertCompleted(t testing.TB) {
+	t.Helper()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.Completed() {
+		t.Errorf("mockTransport is not completed\n%s", m.RequestLogString())
+	}
+	for i, q := range m.queues {
+		if q.expectedCalls == nil {
+			continue
+		}
+		calls := lo.CountBy(m.requestLogs, func(l requestLog) bool { return l.queueIndex == i })
+		if calls != *q.expectedCalls {
+			t.Errorf("unexpected call count for queue %d: expected %d, got %d", i, *q.expectedCalls, calls)
+		}
+	}
+}
+
+// AssertServedBody reports an error on t unless the body of the served response at index (0-based, in ServedResponses order)
+// equals want. Only the bytes the client has read are captured, so read the body to the end first.
+// Responses are only captured after EnableResponseCapture.
+func (m *MockTransport) AssertServedBody(t testing.TB, index int, want string) {
+	t.Helper()
+	m.mu.Lock()
+	served := slices.Clone(m.served)
+	m.mu.Unlock()
+	if index < 0 || index >= len(served) {
+		t.Errorf("no served response at index %d: %d served", index, len(served))
+		return
+	}
+	if got := string(served[index].body.Bytes()); got != want {
+		t.Errorf("unexpected body of served response %d: expected %q, got %q", index, want, got)
+	}
+}
+
+// AssertTranscript reports an error on t with a diff unless RequestLogString equals expected.
+func (m *MockTransport) AssertTranscript(t testing.TB, expected string) {
+	t.Helper()
+	m.mu.Lock()
+	got := m.RequestLogString()
+	m.mu.Unlock()
+	if diff := gocmp.Diff(expected, got); diff != "" {
+		t.Errorf("unexpected request log (-expected +got):\n%s", diff)
+	}
+}
+
+// AssertRequestCount reports an error on t, along with the request log, unless the transport received exactly n requests.
+// Unlike Completed, it counts matched and unmatched requests alike, so it catches both missing and extra calls.
+func (m *MockTransport) AssertRequestCount(t testing.TB, n int) {
+	t.Helper()
+	m.mu.Lock()
+	got, log := len(m.requestLogs), m.RequestLogString()
+	m.mu.Unlock()
+	if got != n {
+		t.Errorf("unexpected request count: expected %d, got %d\n%s", n, got, log)
+	}
+}
+
+// AssertAllRequests reports an error on t with msg unless every matched request satisfies pred.
+// The error names the first violating request by its 1-based number in RequestLogString.
+func (m *MockTransport) AssertAllRequests(t testing.TB, pred func(*http.Request) bool, msg string) {
+	t.Helper()
+	m.mu.Lock()
+	logs := slices.Clone(m.requestLogs)
+	m.mu.Unlock()
+	for i, l := range logs {
+		if l.matched && !pred(l.request) {
+			t.Errorf("%s: request %d does not satisfy the predicate: %s", msg, i+1, l.String())
+			return
+		}
+	}
+}
+
+// OriginGroup registers several queues under one origin. The queues are added to the transport by Done.
+type OriginGroup struct {
+	m      *MockTransport
+	origin string
+	queues []RoundTripQueue
+}
+
+// Origin starts a group of queues for origin, e.g.
+//
+//	m.Origin("http://example.com").
+//		Get("/users", func(q RoundTripQueue) RoundTripQueue { return q.ResponseSimple(200, "[]") }).
+//		Done()
+func (m *MockTransport) Origin(origin string) *OriginGroup {
+	return &OriginGroup{m: m, origin: origin}
+}
+
+func (g *OriginGroup) add(q RoundTripQueue, build func(RoundTripQueue) RoundTripQueue) *OriginGroup {
+	g.queues = append(g.queues, build(q))
+	return g
+}
+
+func (g *OriginGroup) Get(path string, build func(RoundTripQueue) RoundTripQueue) *OriginGroup {
+	return g.add(New(g.origin).Get(path), build)
+}
+
+func (g *OriginGroup) Post(path string, build func(RoundTripQueue) RoundTripQueue) *OriginGroup {
+	return g.add(New(g.origin).Post(path), build)
+}
+
+func (g *OriginGroup) Put(path string, build func(RoundTripQueue) RoundTripQueue) *OriginGroup {
+	return g.add(New(g.origin).Put(path), build)
+}
+
+func (g *OriginGroup) Delete(path string, build func(RoundTripQueue) RoundTripQueue) *OriginGroup {
+	return g.add(New(g.origin).Delete(path), build)
+}
+
+func (g *OriginGroup) Patch(path string, build func(RoundTripQueue) RoundTripQueue) *OriginGroup {
+	return g.add(New(g.origin).Patch(path), build)
+}
+
+func (g *OriginGroup) Head(path string, build func(RoundTripQueue) RoundTripQueue) *OriginGroup {
+	return g.add(New(g.origin).Head(path), build)
+}
+
+func (g *OriginGroup) Options(path string, build func(RoundTripQueue) RoundTripQueue) *OriginGroup {
+	return g.add(New(g.origin).Options(path), build)
+}
+
+// Done appends the group's queues to the transport, after any queues already registered, and returns the transport.
+func (g *OriginGroup) Done() *MockTransport {
+	g.m.mu.Lock()
+	defer g.m.mu.Unlock()
+
+	g.m.queues = append(g.m.queues, lo.ToSlicePtr(g.queues)...)
+	g.queues = nil
+	return g.m
+}
+
+type MatchFunc func(*http.Request) (bool, error)
+
+// roundTrip queue
+type RoundTripQueue struct {
+	origin         string
+	name           string
+	matchFuncs     []MatchFunc
+	roundTripFuncs []func(*http.Request) (*http.Response, error)
+	// ringFuncs are served in rotation once roundTripFuncs is exhausted and are never consumed.
+	ringFuncs []func(*http.Request) (*http.Response, error)
+	ringIndex int
+	// route is set by Route to extract path params for PathParam.
+	route routeTemplate
+	// expectedCalls is set by ExpectCalls and verified by AssertCompleted.
+	expectedCalls *int
+	// delayFunc is set by ResponseDelayFunc to delay each response of the queue.
+	delayFunc func(*http.Request) time.Duration
+	// vary is set by VaryOn and used by the responses of ResponseVaried.
+	vary []string
+	// detachAfter is set by DetachAfter; servedCount counts the requests the queue has served.
+	detachAfter *int
+	servedCount int
+	// ringStates are the ring responses that keep state between requests, such as SucceedThenFail's call count.
+	ringStates []indexedRingState
+	// timeWindows are set by WithinTimeWindow and checked against the time RoundTrip received the request.
+	timeWindows []timeWindow
+}
+
+func New(origin string) RoundTripQueue {
+	matchFuncs := []MatchFunc{
+		func(req *http.Request) (bool, error) {
+			return req.URL.Scheme+"://"+req.URL.Host == origin, nil
+		},
+	}
+	return RoundTripQueue{
+		origin:         origin,
+		matchFuncs:     matchFuncs,
+		roundTripFuncs: make([]func(*http.Request) (*http.Response, error), 0),
+	}
+}
+
+// ResponseFromDir returns a queue serving GET and HEAD requests to origin from files under dir, so a large static API
+// does not need a queue per endpoint. The URL path is cleaned and mapped to a file relative to dir: the file at the
+// path itself if it exists, otherwise the path with ".json" appended, e.g. /users/1 to users/1.json. The root and paths
+// ending in "/" map to index.json in that directory. Missing files are served as 404 Not Found. Like ResponseRing the
+// responses are not consumed, and they do not keep Completed from returning true.
+func ResponseFromDir(origin, dir string) RoundTripQueue {
+	fsys := os.DirFS(dir)
+	q := New(origin).Matcher(func(req *http.Request) (bool, error) {
+		return req.Method == http.MethodGet || req.Method == http.MethodHead, nil
+	})
+	q.ringFuncs = append(q.ringFuncs, func(req *http.Request) (*http.Response, error) {
+		return serveDirFile(fsys, req)
+	})
+	return q
+}
+
+// serveDirFile serves the file resolveDirFile maps req to, with an empty body for HEAD requests, or 404 Not Found.
+func serveDirFile(fsys fs.FS, req *http.Request) (*http.Response, error) {
+	name, found, err := resolveDirFile(fsys, req.URL.Path)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return &http.Response{
+			StatusCode: http.StatusNotFound,
+			Body:       http.NoBody,
+			Request:    req,
+		}, nil
+	}
+	b, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	header := http.Header{}
+	if contentType := mime.TypeByExtension(path.Ext(name)); contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	if req.Method == http.MethodHead {
+		b = nil
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     header,
+		Body:       io.NopCloser(bytes.NewReader(b)),
+		Request:    req,
+	}, nil
+}
+
+// resolveDirFile maps urlPath to a regular file in fsys as described in ResponseFromDir.
+// It reports false if there is no such file.
+func resolveDirFile(fsys fs.FS, urlPath string) (string, bool, error) {
+	name := strings.TrimPrefix(path.Clean("/"+urlPath), "/")
+	if name == "" || strings.HasSuffix(urlPath, "/") {
+		name = path.Join(name, "index.json")
+	}
+	candidates := []string{name}
+	if !strings.HasSuffix(name, ".json") {
+		candidates = append(candidates, name+".json")
+	}
+	for _, name := range candidates {
+		info, err := fs.Stat(fsys, name)
+		if errors.Is(err, fs.ErrNotExist) || err == nil && info.IsDir() {
+			continue
+		}
+		if err != nil {
+			return "", false, err
+		}
+		return name, true, nil
+	}
+	return "", false, nil
+}
+
+// Name labels the queue so that its state can be looked up with RemainingFor.
+func (q RoundTripQueue) Name(name string) RoundTripQueue {
+	q.name = name
+	return q
+}
+
+// DetachAfter removes the queue from matching once it has served n requests, so that later queues with the same
+// criteria take over, e.g. for warm-up responses. Responses left in a detached queue are not counted by Completed.
+func (q RoundTripQueue) DetachAfter(n int) RoundTripQueue {
+	q.detachAfter = &n
+	return q
+}
+
+// ExpectCalls declares that the queue should match exactly n requests, which AssertCompleted verifies.
+func (q RoundTripQueue) ExpectCalls(n int) RoundTripQueue {
+	q.expectedCalls = &n
+	return q
+}
+
+func (q *RoundTripQueue) clone() *RoundTripQueue {
+	cloned := *q
+	cloned.matchFuncs = slices.Clone(q.matchFuncs)
+	cloned.roundTripFuncs = slices.Clone(q.roundTripFuncs)
+	cloned.ringFuncs = slices.Clone(q.ringFuncs)
+	// Copy the state of stateful ring responses so that the clone does not share it with q
+	cloned.ringStates = lo.Map(q.ringStates, func(s indexedRingState, _ int) indexedRingState {
+		state := s.state.copyState()
+		cloned.ringFuncs[s.index] = state.serve
+		return indexedRingState{index: s.index, state: state}
+	})
+	return &cloned
+}
+
+// ringState is a ring response that keeps state between requests.
+// copyState returns an independent copy of it, taken under its lock.
+type ringState interface {
+	serve(req *http.Request) (*http.Response, error)
+	copyState() ringState
+}
+
+type indexedRingState struct {
+	index int
+	state ringState
+}
+
+// ringResponse appends state to the ring responses, recording it so that clone can copy it.
+func (q RoundTripQueue) ringResponse(state ringState) RoundTripQueue {
+	q.ringStates = append(slices.Clone(q.ringStates), indexedRingState{index: len(q.ringFuncs), state: state})
+	q.ringFuncs = append(q.ringFuncs, state.serve)
+	return q
+}
+
+func (q *RoundTripQueue) servable() bool {
+	return !q.detached() && (len(q.roundTripFuncs) != 0 || len(q.ringFuncs) != 0)
+}
+
+// detached reports whether the queue has served the number of requests set by DetachAfter.
+func (q *RoundTripQueue) detached() bool {
+	return q.detachAfter != nil && q.servedCount >= *q.detachAfter
+}
+
+// next retrieves the roundTrip to serve, consuming it unless it belongs to the ring.
+func (q *RoundTripQueue) next() func(*http.Request) (*http.Response, error) {
+	q.servedCount++
+	if len(q.roundTripFuncs) != 0 {
+		roundTrip := q.roundTripFuncs[0]
+		q.roundTripFuncs = q.roundTripFuncs[1:]
+		return roundTrip
+	}
+	roundTrip := q.ringFuncs[q.ringIndex%len(q.ringFuncs)]
+	q.ringIndex++
+	return roundTrip
+}
+
+func (q RoundTripQueue) match(req *http.Request) (bool, error) {
+	return q.matchVerbose(req, time.Now(), nil, 0)
+}
+
+// matchVerbose is match that also writes each evaluated matcher's label and result to w, if w is not nil.
+// Like match, it stops at the first matcher that fails.
+func (q RoundTripQueue) matchVerbose(req *http.Request, at time.Time, w io.Writer, index int) (bool, error) {
+	var results []string
+	logResults := func() {
+		if w != nil {
+			fmt.Fprintf(w, "  queue %d: %s\n", index, strings.Join(results, " "))
+		}
+	}
+	for _, f := range q.matchFuncs {
+		m, err := f(req)
+		if err != nil {
+			results = append(results, fmt.Sprintf("%s=error(%v)", matcherLabel(f), err))
+			logResults()
+			return false, err
+		}
+		results = append(results, fmt.Sprintf("%s=%t", matcherLabel(f), m))
+		if !m {
+			logResults()
+			return false, nil
+		}
+	}
+	for _, window := range q.timeWindows {
+		m := !at.Before(window.start) && !at.After(window.end)
+		results = append(results, fmt.Sprintf("WithinTimeWindow=%t", m))
+		if !m {
+			logResults()
+			return false, nil
+		}
+	}
+	logResults()
+	return true, nil
+}
+
+func (q RoundTripQueue) Header(key, value string) RoundTripQueue {
+	q.matchFuncs = append(q.matchFuncs, func(req *http.Request) (bool, error) {
+		return req.Header.Get(key) == value, nil
+	})
+	return q
+}
+
+// HeaderAbsent matches when the request does not carry the header key at all, the negation of Header.
+func (q RoundTripQueue) HeaderAbsent(key string) RoundTripQueue {
+	q.matchFuncs = append(q.matchFuncs, func(req *http.Request) (bool, error) {
+		_, present := req.Header[http.CanonicalHeaderKey(key)]
+		return !present && req.Header.Get(key) == "", nil
+	})
+	return q
+}
+
+// SignatureMatch matches when the headerKey header equals the signature recomputed by compute, e.g. an HMAC over the body.
+// compute may read the request body, which is restored afterwards for later matchers and the response func.
+func (q RoundTripQueue) SignatureMatch(headerKey string, compute func(*http.Request) (string, error)) RoundTripQueue {
+	q.matchFuncs = append(q.matchFuncs, func(req *http.Request) (bool, error) {
+		body, err := peekBody(req)
+		if err != nil {
+			return false, err
+		}
+		expected, err := compute(req)
+		if req.Body != nil {
+			req.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		if err != nil {
+			return false, err
+		}
+		got := req.Header.Get(headerKey)
+		return got != "" && got == expected, nil
+	})
+	return q
+}
+
+// HasRange matches range requests, i.e. requests with a Range header.
+func (q RoundTripQueue) HasRange() RoundTripQueue {
+	q.matchFuncs = append(q.matchFuncs, func(req *http.Request) (bool, error) {
+		return req.Header.Get("Range") != "", nil
+	})
+	return q
+}
+
+// NoRange matches requests without a Range header, the complement of HasRange.
+func (q RoundTripQueue) NoRange() RoundTripQueue {
+	return q.HeaderAbsent("Range")
+}
+
+// VaryOn matches requests carrying every one of headers, the request headers a cache keys on,
+// and makes ResponseVaried select its response by their values.
+func (q RoundTripQueue) VaryOn(headers ...string) RoundTripQueue {
+	q.vary = headers
+	q.matchFuncs = append(q.matchFuncs, func(req *http.Request) (bool, error) {
+		for _, key := range headers {
+			if req.Header.Get(key) == "" {
+				return false, nil
+			}
+		}
+		return true, nil
+	})
+	return q
+}
+
+// HeadersExact matches when the request's header set equals want, ignoring headers Go adds automatically:
+// Host, Content-Length, Accept-Encoding and the default Go-http-client User-Agent.
+func (q RoundTripQueue) HeadersExact(want http.Header) RoundTripQueue {
+	expected := http.Header{}
+	for key, values := range want {
+		expected[http.CanonicalHeaderKey(key)] = values
+	}
+	q.matchFuncs = append(q.matchFuncs, func(req *http.Request) (bool, error) {
+		got := significantHeaders(req.Header)
+		if len(got) != len(expected) {
+			return false, nil
+		}
+		for key, values := range expected {
+			if !slices.Equal(got[key], values) {
+				return false, nil
+			}
+		}
+		return true, nil
+	})
+	return q
+}
+
+// HeaderCount matches when the request carries exactly n distinct header keys, ignoring the headers
+// Go adds automatically as HeadersExact does: Host, Content-Length, Accept-Encoding and the default Go-http-client User-Agent.
+func (q RoundTripQueue) HeaderCount(n int) RoundTripQueue {
+	q.matchFuncs = append(q.matchFuncs, func(req *http.Request) (bool, error) {
+		return len(significantHeaders(req.Header)) == n, nil
+	})
+	return q
+}
+
+// RequestLine matches the reconstructed request line "METHOD path?query HTTP/x.y".
+// An empty req.Proto is treated as HTTP/1.1, as net/http does when writing the request.
+func (q RoundTripQueue) RequestLine(line string) RoundTripQueue {
+	q.matchFuncs = append(q.matchFuncs, func(req *http.Request) (bool, error) {
+		proto := req.Proto
+		if proto == "" {
+			proto = "HTTP/1.1"
+		}
+		return fmt.Sprintf("%s %s %s", req.Method, req.URL.RequestURI(), proto) == line, nil
+	})
+	return q
+}
+
+// UserAgentAtLeast matches when the User-Agent has a "name/version" product whose version is minVersion or newer.
+// Versions are compared numerically component by component; missing or unparseable User-Agents do not match.
+func (q RoundTripQueue) UserAgentAtLeast(name string, minVersion string) RoundTripQueue {
+	least, minErr := parseVersion(minVersion)
+	q.matchFuncs = append(q.matchFuncs, func(req *http.Request) (bool, error) {
+		if minErr != nil {
+			return false, minErr
+		}
+		for _, product := range strings.Fields(req.Header.Get("User-Agent")) {
+			version, ok := strings.CutPrefix(product, name+"/")
+			if !ok {
+				continue
+			}
+			got, err := parseVersion(version)
+			if err != nil {
+				return false, nil
+			}
+			return compareVersion(got, least) >= 0, nil
+		}
+		return false, nil
+	})
+	return q
+}
+
+// AuthScheme matches when the Authorization header uses scheme (e.g. "Bearer"), regardless of the credentials.
+// The scheme is compared case-insensitively.
+func (q RoundTripQueue) AuthScheme(scheme string) RoundTripQueue {
+	q.matchFuncs = append(q.matchFuncs, func(req *http.Request) (bool, error) {
+		got, _, found := strings.Cut(req.Header.Get("Authorization"), " ")
+		return found && strings.EqualFold(got, scheme), nil
+	})
+	return q
+}
+
+// JWTClaim matches when the bearer token in the Authorization header is a JWT whose payload has claim equal to value,
+// compared as JSON. The signature is not verified. Missing or malformed tokens do not match.
+func (q RoundTripQueue) JWTClaim(claim string, value any) RoundTripQueue {
+	var want any
+	b, wantErr := json.Marshal(value)
+	if wantErr == nil {
+		wantErr = json.Unmarshal(b, &want)
+	}
+	q.matchFuncs = append(q.matchFuncs, func(req *http.Request) (bool, error) {
+		if wantErr != nil {
+			return false, wantErr
+		}
+		scheme, token, _ := strings.Cut(req.Header.Get("Authorization"), " ")
+		if !strings.EqualFold(scheme, "Bearer") {
+			return false, nil
+		}
+		parts := strings.Split(token, ".")
+		if len(parts) != 3 {
+			return false, nil
+		}
+		payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+		if err != nil {
+			return false, nil
+		}
+		var claims map[string]any
+		if err := json.Unmarshal(payload, &claims); err != nil {
+			return false, nil
+		}
+		got, ok := claims[claim]
+		return ok && reflect.DeepEqual(got, want), nil
+	})
+	return q
+}
+
+// HostHeader matches the Host header sent with the request, which is req.Host or,
+// when that is empty, req.URL.Host as in net/http.
+func (q RoundTripQueue) HostHeader(value string) RoundTripQueue {
+	q.matchFuncs = append(q.matchFuncs, func(req *http.Request) (bool, error) {
+		host := req.Host
+		if host == "" {
+			host = req.URL.Host
+		}
+		return host == value, nil
+	})
+	return q
+}
+
+// RequireHTTPS matches only requests with the https scheme, e.g. to assert a client never downgrades to plain HTTP.
+func (q RoundTripQueue) RequireHTTPS() RoundTripQueue {
+	q.matchFuncs = append(q.matchFuncs, func(req *http.Request) (bool, error) {
+		return req.URL.Scheme == "https", nil
+	})
+	return q
+}
+
+// IsProxyRequest matches when the request target in req.RequestURI is in absolute form ("http://host/path"),
+// as sent to a forward proxy. Client requests leave RequestURI empty, so such requests are typically built with
+// http.ReadRequest from a line like "GET http://example.com/ HTTP/1.1" and passed to RoundTrip directly,
+// since http.Client rejects requests with RequestURI set.
+func (q RoundTripQueue) IsProxyRequest() RoundTripQueue {
+	q.matchFuncs = append(q.matchFuncs, func(req *http.Request) (bool, error) {
+		u, err := url.ParseRequestURI(req.RequestURI)
+		return err == nil && u.IsAbs() && u.Host != "", nil
+	})
+	return q
+}
+
+// ServerName matches the TLS SNI server name in req.TLS.ServerName.
+// Requests without req.TLS, which includes most client requests, do not match.
+func (q RoundTripQueue) ServerName(name string) RoundTripQueue {
+	q.matchFuncs = append(q.matchFuncs, func(req *http.Request) (bool, error) {
+		return req.TLS != nil && req.TLS.ServerName == name, nil
+	})
+	return q
+}
+
+func (q RoundTripQueue) method(method string) RoundTripQueue {
+	q.matchFuncs = append(q.matchFuncs, func(req *http.Request) (bool, error) {
+		return req.Method == method, nil
+	})
+	return q
+}
+
+// Method matches the request method exactly, for combining with path matchers such as PathRegexp.
+func (q RoundTripQueue) Method(method string) RoundTripQueue {
+	return q.method(method)
+}
+
+// MethodInsensitive matches the request method case-insensitively, to tolerate clients sending e.g. "get".
+// HTTP methods are case-sensitive, so prefer Get, Post etc. unless such clients are under test.
+func (q RoundTripQueue) MethodInsensitive(method string) RoundTripQueue {
+	q.matchFuncs = append(q.matchFuncs, func(req *http.Request) (bool, error) {
+		return strings.EqualFold(req.Method, method), nil
+	})
+	return q
+}
+
+func (q RoundTripQueue) path(path string) RoundTripQueue {
+	q.matchFuncs = append(q.matchFuncs, func(req *http.Request) (bool, error) {
+		return req.URL.Path == path, nil
+	})
+	return q
+}
+
+// RequestTarget matches the request target: the path, or for target "*" the asterisk form of server-wide
+// "OPTIONS *" requests. A client builds such a request with http.NewRequest("OPTIONS", "http://example.com", nil)
+// and sets req.URL.Opaque = "*"; a server-side request read by http.ReadRequest has "*" as its path.
+func (q RoundTripQueue) RequestTarget(target string) RoundTripQueue {
+	q.matchFuncs = append(q.matchFuncs, func(req *http.Request) (bool, error) {
+		if target == "*" {
+			return req.URL.Opaque == "*" || req.URL.Path == "*", nil
+		}
+		return req.URL.Opaque == "" && req.URL.Path == target, nil
+	})
+	return q
+}
+
+// PathInsensitive matches the request path case-insensitively, to test servers that treat paths that way.
+// Standard HTTP paths are case-sensitive, so prefer Get, Post etc. unless this tolerance is under test.
+func (q RoundTripQueue) PathInsensitive(path string) RoundTripQueue {
+	q.matchFuncs = append(q.matchFuncs, func(req *http.Request) (bool, error) {
+		return strings.EqualFold(req.URL.Path, path), nil
+	})
+	return q
+}
+
+// PathRegexp matches when the request path matches pattern, e.g. `^/v2/users/\d+/posts/\d+$`.
+// An invalid pattern is reported as an error from the matcher.
+func (q RoundTripQueue) PathRegexp(pattern string) RoundTripQueue {
+	re, compileErr := regexp.Compile(pattern)
+	q.matchFuncs = append(q.matchFuncs, func(req *http.Request) (bool, error) {
+		if compileErr != nil {
+			return false, compileErr
+		}
+		return re.MatchString(req.URL.Path), nil
+	})
+	return q
+}
+
+// Route matches method and a path template such as "/users/{id}", where each {param} matches one non-empty segment.
+// Response funcs can read the extracted params with PathParam. Like PathTemplate, it panics if the queue already has a route.
+func (q RoundTripQueue) Route(method, template string) RoundTripQueue {
+	return q.method(method).PathTemplate(template)
+}
+
+// PathTemplate matches a path template such as "/users/:id/posts/:postID", where each :param (or {param})
+// segment matches one non-empty segment and other segments must be equal. The number of segments must match
+// exactly, so a trailing slash counts as an extra empty segment: "/users/:id" does not match "/users/7/",
+// and "/users/:id/" does not match "/users/7". Response funcs can read the captured params with PathParam.
+// A queue has a single route, so it panics if Route or PathTemplate has already been called.
+func (q RoundTripQueue) PathTemplate(template string) RoundTripQueue {
+	if q.route != nil {
+		panic(fmt.Sprintf("PathTemplate(%q) called on a queue that already has a route", template))
+	}
+	route := parseRoute(template)
+	q.route = route
+	q.matchFuncs = append(q.matchFuncs, func(req *http.Request) (bool, error) {
+		_, ok := route.match(req.URL.Path)
+		return ok, nil
+	})
+	return q
+}
+
+type pathParamsContextKey struct{}
+
+// PathParam returns the path param name extracted by Route or PathTemplate for the request passed to a response func,
+// or "" if there is no such param.
+func PathParam(req *http.Request, name string) string {
+	params, _ := req.Context().Value(pathParamsContextKey{}).(map[string]string)
+	return params[name]
+}
+
+func (q RoundTripQueue) Get(path string) RoundTripQueue {
+	return q.method(http.MethodGet).path(path)
+}
+
+func (q RoundTripQueue) Post(path string) RoundTripQueue {
+	return q.method(http.MethodPost).path(path)
+}
+
+func (q RoundTripQueue) Put(path string) RoundTripQueue {
+	return q.method(http.MethodPut).path(path)
+}
+
+func (q RoundTripQueue) Delete(path string) RoundTripQueue {
+	return q.method(http.MethodDelete).path(path)
+}
+
+func (q RoundTripQueue) Patch(path string) RoundTripQueue {
+	return q.method(http.MethodPatch).path(path)
+}
+
+// Head matches HEAD requests to path. Responses to HEAD requests should have an empty body.
+func (q RoundTripQueue) Head(path string) RoundTripQueue {
+	return q.method(http.MethodHead).path(path)
+}
+
+func (q RoundTripQueue) Options(path string) RoundTripQueue {
+	return q.method(http.MethodOptions).path(path)
+}
+
+func (q RoundTripQueue) Query(key, value string) RoundTripQueue {
+	q.matchFuncs = append(q.matchFuncs, func(req *http.Request) (bool, error) {
+		return req.URL.Query().Get(key) == value, nil
+	})
+	return q
+}
+
+// QueryContains matches when the request query has every key in pairs with the given value, ignoring other parameters.
+func (q RoundTripQueue) QueryContains(pairs map[string]string) RoundTripQueue {
+	q.matchFuncs = append(q.matchFuncs, func(req *http.Request) (bool, error) {
+		query := req.URL.Query()
+		for key, value := range pairs {
+			if !query.Has(key) || query.Get(key) != value {
+				return false, nil
+			}
+		}
+		return true, nil
+	})
+	return q
+}
+
+// QueryRegex matches when the value of the query key matches pattern.
+// An invalid pattern is reported as an error from the matcher.
+func (q RoundTripQueue) QueryRegex(key, pattern string) RoundTripQueue {
+	re, compileErr := regexp.Compile(pattern)
+	q.matchFuncs = append(q.matchFuncs, func(req *http.Request) (bool, error) {
+		if compileErr != nil {
+			return false, compileErr
+		}
+		return re.MatchString(req.URL.Query().Get(key)), nil
+	})
+	return q
+}
+
+// QuerySingleValue matches when the request sends exactly one value for the query key.
+func (q RoundTripQueue) QuerySingleValue(key string) RoundTripQueue {
+	q.matchFuncs = append(q.matchFuncs, func(req *http.Request) (bool, error) {
+		return len(req.URL.Query()[key]) == 1, nil
+	})
+	return q
+}
+
+func (q RoundTripQueue) BodyString(body string) RoundTripQueue {
+	q.matchFuncs = append(q.matchFuncs, func(req *http.Request) (bool, error) {
+		got, err := peekBody(req)
+		if err != nil {
+			return false, err
+		}
+		return string(got) == body, nil
+	})
+	return q
+}
+
+// BodyRegex matches when the request body matches pattern.
+// An invalid pattern is reported as an error from the matcher.
+func (q RoundTripQueue) BodyRegex(pattern string) RoundTripQueue {
+	re, compileErr := regexp.Compile(pattern)
+	q.matchFuncs = append(q.matchFuncs, func(req *http.Request) (bool, error) {
+		if compileErr != nil {
+			return false, compileErr
+		}
+		got, err := peekBody(req)
+		if err != nil {
+			return false, err
+		}
+		return re.Match(got), nil
+	})
+	return q
+}
+
+// IsMultipart matches any request whose Content-Type media type is multipart/form-data, regardless of its fields.
+func (q RoundTripQueue) IsMultipart() RoundTripQueue {
+	q.matchFuncs = append(q.matchFuncs, func(req *http.Request) (bool, error) {
+		mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		return err == nil && mediaType == "multipart/form-data", nil
+	})
+	return q
+}
+
+// BodyHash matches when the hex digest of the request body computed with algo ("md5", "sha1" or "sha256") equals hexDigest.
+// The digest is compared case-insensitively; an unsupported algo is reported as an error from the matcher.
+func (q RoundTripQueue) BodyHash(algo string, hexDigest string) RoundTripQueue {
+	q.matchFuncs = append(q.matchFuncs, func(req *http.Request) (bool, error) {
+		var h hash.Hash
+		switch algo {
+		case "md5":
+			h = md5.New()
+		case "sha1":
+			h = sha1.New()
+		case "sha256":
+			h = sha256.New()
+		default:
+			return false, fmt.Errorf("unsupported hash algorithm %q", algo)
+		}
+		got, err := peekBody(req)
+		if err != nil {
+			return false, err
+		}
+		h.Write(got)
+		return strings.EqualFold(hex.EncodeToString(h.Sum(nil)), hexDigest), nil
+	})
+	return q
+}
+
+// ContentMD5Valid matches when the Content-MD5 header is the base64-encoded MD5 of the request body.
+// Requests without the header do not match.
+func (q RoundTripQueue) ContentMD5Valid() RoundTripQueue {
+	q.matchFuncs = append(q.matchFuncs, func(req *http.Request) (bool, error) {
+		header := req.Header.Get("Content-MD5")
+		if header == "" {
+			return false, nil
+		}
+		got, err := peekBody(req)
+		if err != nil {
+			return false, err
+		}
+		sum := md5.Sum(got)
+		return base64.StdEncoding.EncodeToString(sum[:]) == header, nil
+	})
+	return q
+}
+
+// BodyValidUTF8 matches when the request body is valid UTF-8. An empty body matches.
+func (q RoundTripQueue) BodyValidUTF8() RoundTripQueue {
+	q.matchFuncs = append(q.matchFuncs, func(req *http.Request) (bool, error) {
+		got, err := peekBody(req)
+		if err != nil {
+			return false, err
+		}
+		return utf8.Valid(got), nil
+	})
+	return q
+}
+
+// BodyJSON matches when the request body is JSON structurally equal to expected marshaled as JSON,
+// ignoring key order, whitespace and number formatting (1 equals 1.0).
+// A request body that is not valid JSON, or an expected value that cannot be marshaled, is reported as an error from the matcher.
+func (q RoundTripQueue) BodyJSON(expected any) RoundTripQueue {
+	var want any
+	b, wantErr := json.Marshal(expected)
+	if wantErr == nil {
+		wantErr = json.Unmarshal(b, &want)
+	}
+	q.matchFuncs = append(q.matchFuncs, func(req *http.Request) (bool, error) {
+		if wantErr != nil {
+			return false, wantErr
+		}
+		body, err := peekBody(req)
+		if err != nil {
+			return false, err
+		}
+		var got any
+		if err := json.Unmarshal(body, &got); err != nil {
+			return false, fmt.Errorf("invalid JSON request body: %w", err)
+		}
+		return reflect.DeepEqual(got, want), nil
+	})
+	return q
+}
+
+// BodyJSONContains matches when the request body JSON contains subset marshaled as JSON: every key of an object
+// in subset must be present with a contained value, recursively, while extra keys are ignored. Arrays are compared
+// element by element over the indices present in subset. Other values are compared as in BodyJSON.
+// A request body that is not valid JSON is reported as an error from the matcher.
+func (q RoundTripQueue) BodyJSONContains(subset any) RoundTripQueue {
+	var want any
+	b, wantErr := json.Marshal(subset)
+	if wantErr == nil {
+		wantErr = json.Unmarshal(b, &want)
+	}
+	q.matchFuncs = append(q.matchFuncs, func(req *http.Request) (bool, error) {
+		if wantErr != nil {
+			return false, wantErr
+		}
+		body, err := peekBody(req)
+		if err != nil {
+			return false, err
+		}
+		var got any
+		if err := json.Unmarshal(body, &got); err != nil {
+			return false, fmt.Errorf("invalid JSON request body: %w", err)
+		}
+		return jsonContains(got, want), nil
+	})
+	return q
+}
+
+// BodyJSONArrayLen matches when the request body is a JSON array with n elements.
+// Bodies that are not JSON arrays do not match.
+func (q RoundTripQueue) BodyJSONArrayLen(n int) RoundTripQueue {
+	q.matchFuncs = append(q.matchFuncs, func(req *http.Request) (bool, error) {
+		got, err := peekBody(req)
+		if err != nil {
+			return false, err
+		}
+		var items []json.RawMessage
+		if err := json.Unmarshal(got, &items); err != nil {
+			return false, nil
+		}
+		return items != nil && len(items) == n, nil
+	})
+	return q
+}
+
+// WithinTimeWindow matches when RoundTrip received the request within [start, end], as logged in RequestLogEntry.Time.
+// The window is checked after the other matchers of the queue.
+func (q RoundTripQueue) WithinTimeWindow(start, end time.Time) RoundTripQueue {
+	q.timeWindows = append(slices.Clone(q.timeWindows), timeWindow{start: start, end: end})
+	return q
+}
+
+type timeWindow struct {
+	start, end time.Time
+}
+
+// MatchSpec describes matchers declaratively, e.g. for table-driven tests. Empty fields match anything.
+type MatchSpec struct {
+	Method  string
+	Path    string
+	Headers map[string]string
+	Query   map[string]string
+	Body    string
+}
+
+// Match adds the matchers described by spec, as if chaining the corresponding methods such as Header and Query.
+func (q RoundTripQueue) Match(spec MatchSpec) RoundTripQueue {
+	if spec.Method != "" {
+		q = q.method(spec.Method)
+	}
+	if spec.Path != "" {
+		q = q.path(spec.Path)
+	}
+	for key, value := range spec.Headers {
+		q = q.Header(key, value)
+	}
+	for key, value := range spec.Query {
+		q = q.Query(key, value)
+	}
+	if spec.Body != "" {
+		q = q.BodyString(spec.Body)
+	}
+	return q
+}
+
+// JSONRPCMethod matches a JSON-RPC 2.0 request whose body calls method. Bodies that are not JSON-RPC requests do not match.
+func (q RoundTripQueue) JSONRPCMethod(method string) RoundTripQueue {
+	q.matchFuncs = append(q.matchFuncs, func(req *http.Request) (bool, error) {
+		rpc, err := readJSONRPCRequest(req)
+		if err != nil {
+			return false, nil
+		}
+		return rpc.Method == method, nil
+	})
+	return q
+}
+
+// MatchCurl adds matchers for the request described by a cURL command, e.g.
+//
+//	curl -X POST -H 'Content-Type: application/json' -d '{"id":1}' 'http://example.com/users?page=2'
+//
+// The URL must match in scheme, host, path and query; a URL without a scheme defaults to http:// as in cURL.
+// -X/--request, -H/--header and -d/--data/--data-raw are supported; -d without -X implies POST. Flags without
+// a value that do not change the request, such as -s, -L, -k and --compressed, are ignored. Other flags or
+// a malformed command are reported as an error from the matcher.
+func (q RoundTripQueue) MatchCurl(curl string) RoundTripQueue {
+	spec, parseErr := parseCurl(curl)
+	if parseErr != nil {
+		q.matchFuncs = append(q.matchFuncs, func(req *http.Request) (bool, error) {
+			return false, parseErr
+		})
+		return q
+	}
+	q = q.method(spec.method)
+	q.matchFuncs = append(q.matchFuncs, func(req *http.Request) (bool, error) {
+		return req.URL.Scheme == spec.url.Scheme && req.URL.Host == spec.url.Host &&
+			req.URL.Path == spec.url.Path && maps.EqualFunc(req.URL.Query(), spec.url.Query(), slices.Equal), nil
+	})
+	for _, h := range spec.headers {
+		q = q.Header(h[0], h[1])
+	}
+	if spec.data != nil {
+		q = q.BodyString(*spec.data)
+	}
+	return q
+}
+
+func (q RoundTripQueue) Matcher(matchFunc MatchFunc) RoundTripQueue {
+	q.matchFuncs = append(q.matchFuncs, matchFunc)
+	return q
+}
+
+// MatchPreset is a reusable set of matchers applied to a queue with Use.
+type MatchPreset []MatchFunc
+
+func Preset(matchers ...MatchFunc) MatchPreset {
+	return MatchPreset(matchers)
+}
+
+func (q RoundTripQueue) Use(preset MatchPreset) RoundTripQueue {
+	q.matchFuncs = append(q.matchFuncs, preset...)
+	return q
+}
+
+func (q RoundTripQueue) ResponseSimple(statusCode int, body string) RoundTripQueue {
+	q.roundTripFuncs = append(q.roundTripFuncs, func(req *http.Request) (*http.Response, error) {
+		body := normalizeBody(req, body)
+		return &http.Response{
+			StatusCode: statusCode,
+			Body:       io.NopCloser(strings.NewReader(body)),
+			Request:    req,
+		}, nil
+	})
+	return q
+}
+
+// ResponseStatus returns a response with only a status code and an empty body.
+func (q RoundTripQueue) ResponseStatus(statusCode int) RoundTripQueue {
+	q.roundTripFuncs = append(q.roundTripFuncs, func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			Status:     fmt.Sprintf("%d %s", statusCode, http.StatusText(statusCode)),
+			StatusCode: statusCode,
+			Body:       http.NoBody,
+			Request:    req,
+		}, nil
+	})
+	return q
+}
+
+// ResponseEcho returns the request body as the response body, with the request's Content-Type if it has one.
+func (q RoundTripQueue) ResponseEcho(statusCode int) RoundTripQueue {
+	q.roundTripFuncs = append(q.roundTripFuncs, func(req *http.Request) (*http.Response, error) {
+		body, err := peekBody(req)
+		if err != nil {
+			return nil, err
+		}
+		header := http.Header{}
+		if contentType := req.Header.Get("Content-Type"); contentType != "" {
+			header.Set("Content-Type", contentType)
+		}
+		return &http.Response{
+			StatusCode: statusCode,
+			Body:       io.NopCloser(bytes.NewReader(body)),
+			Header:     header,
+			Request:    req,
+		}, nil
+	})
+	return q
+}
+
+// ResponseSetCookies returns a response with an empty body and one Set-Cookie header value per cookie,
+// so that a client with a cookie jar stores all of them. Invalid cookies are dropped, as by http.SetCookie.
+func (q RoundTripQueue) ResponseSetCookies(statusCode int, cookies ...*http.Cookie) RoundTripQueue {
+	q.roundTripFuncs = append(q.roundTripFuncs, func(req *http.Request) (*http.Response, error) {
+		header := http.Header{}
+		for _, cookie := range cookies {
+			if v := cookie.String(); v != "" {
+				header.Add("Set-Cookie", v)
+			}
+		}
+		return &http.Response{
+			StatusCode: statusCode,
+			Body:       http.NoBody,
+			Header:     header,
+			Request:    req,
+		}, nil
+	})
+	return q
+}
+
+// ResponseCloseError returns a response whose Body.Close returns closeErr.
+func (q RoundTripQueue) ResponseCloseError(statusCode int, body string, closeErr error) RoundTripQueue {
+	q.roundTripFuncs = append(q.roundTripFuncs, func(req *http.Request) (*http.Response, error) {
+		body := normalizeBody(req, body)
+		return &http.Response{
+			StatusCode: statusCode,
+			Body:       closeErrorBody{Reader: strings.NewReader(body), err: closeErr},
+			Request:    req,
+		}, nil
+	})
+	return q
+}
+
+// ResponseSmallReads returns a response whose body yields at most chunkSize bytes per Read call.
+// It panics if chunkSize is less than 1.
+func (q RoundTripQueue) ResponseSmallReads(statusCode int, body string, chunkSize int) RoundTripQueue {
+	if chunkSize < 1 {
+		panic(fmt.Sprintf("ResponseSmallReads called with chunkSize = %d", chunkSize))
+	}
+	q.roundTripFuncs = append(q.roundTripFuncs, func(req *http.Request) (*http.Response, error) {
+		body := normalizeBody(req, body)
+		return &http.Response{
+			StatusCode: statusCode,
+			Body:       io.NopCloser(&smallReader{r: strings.NewReader(body), chunkSize: chunkSize}),
+			Request:    req,
+		}, nil
+	})
+	return q
+}
+
+// ResponseAutoCompress gzips body with "Content-Encoding: gzip" when the request's Accept-Encoding
+// accepts gzip, and returns it uncompressed otherwise.
+// Note that the mock bypasses http.Transport, so the client receives the compressed bytes as is.
+func (q RoundTripQueue) ResponseAutoCompress(statusCode int, body string) RoundTripQueue {
+	q.roundTripFuncs = append(q.roundTripFuncs, func(req *http.Request) (*http.Response, error) {
+		body := normalizeBody(req, body)
+		res := &http.Response{
+			StatusCode: statusCode,
+			Header:     http.Header{},
+			Body:       io.NopCloser(strings.NewReader(body)),
+			Request:    req,
+		}
+		if !acceptsGzip(req.Header.Get("Accept-Encoding")) {
+			return res, nil
+		}
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write([]byte(body)); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		res.Header.Set("Content-Encoding", "gzip")
+		res.Body = io.NopCloser(&buf)
+		return res, nil
+	})
+	return q
+}
+
+// SSEvent is a server-sent event. An empty Event or ID is omitted from the stream, but Data is always written,
+// as an empty "data:" line for an empty Data, since clients dispatch no event without a data line.
+// Delay postpones delivery of the event, measured from when the previous event was read.
+type SSEvent struct {
+	Event string
+	Data  string
+	ID    string
+	Delay time.Duration
+}
+
+func (e SSEvent) String() string {
+	var b strings.Builder
+	if e.ID != "" {
+		b.WriteString("id: " + e.ID + "\n")
+	}
+	if e.Event != "" {
+		b.WriteString("event: " + e.Event + "\n")
+	}
+	for _, line := range strings.Split(e.Data, "\n") {
+		b.WriteString("data: " + line + "\n")
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
+// ResponseSSE returns a "text/event-stream" response delivering events in order, each after its Delay.
+// The stream fails with the context error if the request context is done while waiting.
+func (q RoundTripQueue) ResponseSSE(events ...SSEvent) RoundTripQueue {
+	q.roundTripFuncs = append(q.roundTripFuncs, func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": []string{"text/event-stream"}},
+			Body:       io.NopCloser(&sseReader{ctx: req.Context(), events: events}),
+			Request:    req,
+		}, nil
+	})
+	return q
+}
+
+// ResponseChannel returns a response whose body yields the chunks received from ch and ends when ch is closed.
+// Reading fails with the context error if the request context is done while waiting for a chunk.
+func (q RoundTripQueue) ResponseChannel(statusCode int, ch <-chan []byte) RoundTripQueue {
+	q.roundTripFuncs = append(q.roundTripFuncs, func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: statusCode,
+			Body:       io.NopCloser(&chanReader{ctx: req.Context(), ch: ch}),
+			Request:    req,
+		}, nil
+	})
+	return q
+}
+
+func (q RoundTripQueue) ResponseJSON(statusCode int, body any) RoundTripQueue {
+	b, err := json.Marshal(body)
+	if err != nil {
+		panic(err)
+	}
+
+	q.roundTripFuncs = append(q.roundTripFuncs, func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: statusCode,
+			Body:       io.NopCloser(bytes.NewBuffer(b)),
+			Header:     http.Header{"Content-Type": []string{"application/json"}},
+			Request:    req,
+		}, nil
+	})
+	return q
+}
+
+// ResponseJSONRPCResult returns a JSON-RPC 2.0 response with result marshaled as JSON and the id of the request.
+func (q RoundTripQueue) ResponseJSONRPCResult(result any) RoundTripQueue {
+	b, err := json.Marshal(result)
+	if err != nil {
+		panic(err)
+	}
+	return q.responseJSONRPC(func(res *jsonRPCResponse) { res.Result = b })
+}
+
+// ResponseJSONRPCError returns a JSON-RPC 2.0 error response with code and message and the id of the request.
+func (q RoundTripQueue) ResponseJSONRPCError(code int, message string) RoundTripQueue {
+	return q.responseJSONRPC(func(res *jsonRPCResponse) { res.Error = &jsonRPCError{Code: code, Message: message} })
+}
+
+func (q RoundTripQueue) responseJSONRPC(fill func(*jsonRPCResponse)) RoundTripQueue {
+	q.roundTripFuncs = append(q.roundTripFuncs, func(req *http.Request) (*http.Response, error) {
+		rpc, err := readJSONRPCRequest(req)
+		if err != nil {
+			return nil, err
+		}
+		envelope := jsonRPCResponse{JSONRPC: "2.0", ID: rpc.ID}
+		fill(&envelope)
+		b, err := json.Marshal(envelope)
+		if err != nil {
+			return nil, err
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(bytes.NewReader(b)),
+			Header:     http.Header{"Content-Type": []string{"application/json"}},
+			Request:    req,
+		}, nil
+	})
+	return q
+}
+
+// ResponseJSONP wraps body marshaled as JSON in the callback named by the request's callbackParam
+// query parameter, as "callback(<json>);". The round trip fails if the parameter is missing.
+func (q RoundTripQueue) ResponseJSONP(statusCode int, callbackParam string, body any) RoundTripQueue {
+	b, err := json.Marshal(body)
+	if err != nil {
+		panic(err)
+	}
+
+	q.roundTripFuncs = append(q.roundTripFuncs, func(req *http.Request) (*http.Response, error) {
+		callback := req.URL.Query().Get(callbackParam)
+		if callback == "" {
+			return nil, fmt.Errorf("missing JSONP callback parameter %q", callbackParam)
+		}
+		return &http.Response{
+			StatusCode: statusCode,
+			Body:       io.NopCloser(strings.NewReader(fmt.Sprintf("%s(%s);", callback, b))),
+			Header:     http.Header{"Content-Type": []string{"application/javascript"}},
+			Request:    req,
+		}, nil
+	})
+	return q
+}
+
+// ResponseRawHeaders returns a response with header lines such as "x-Custom-ID: 1" stored under their key as written,
+// bypassing http.Header canonicalization. Note that Header.Get and Header.Values canonicalize the key on lookup,
+// so read such headers by indexing the map directly; net/http itself may still canonicalize them elsewhere.
+func (q RoundTripQueue) ResponseRawHeaders(statusCode int, body string, lines ...string) RoundTripQueue {
+	header := http.Header{}
+	for _, line := range lines {
+		key, value, found := strings.Cut(line, ":")
+		if !found {
+			panic(fmt.Sprintf("invalid header line %q", line))
+		}
+		header[key] = append(header[key], strings.TrimSpace(value))
+	}
+
+	q.roundTripFuncs = append(q.roundTripFuncs, func(req *http.Request) (*http.Response, error) {
+		body := normalizeBody(req, body)
+		return &http.Response{
+			StatusCode: statusCode,
+			Body:       io.NopCloser(strings.NewReader(body)),
+			Header:     header.Clone(),
+			Request:    req,
+		}, nil
+	})
+	return q
+}
+
+// ResponseFromDump returns the response parsed from a raw HTTP response dump,
+// such as the output of httputil.DumpResponse. It panics if the dump cannot be parsed.
+func (q RoundTripQueue) ResponseFromDump(dump []byte) RoundTripQueue {
+	res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(dump)), nil)
+	if err != nil {
+		panic(err)
+	}
+	// replayable buffers the body, which http.ReadResponse reads lazily from the dump
+	q.roundTripFuncs = append(q.roundTripFuncs, replayable(res))
+	return q
+}
+
+func (q RoundTripQueue) Response(res *http.Response) RoundTripQueue {
+	q.roundTripFuncs = append(q.roundTripFuncs, func(req *http.Request) (*http.Response, error) {
+		return res, nil
+	})
+	return q
+}
+
+// ResponseFactory calls fn each time the response is served, so every request gets a fresh body.
+// Use it instead of Response for responses with bodies that are served repeatedly, since an *http.Response
+// body can only be read once. The response's Request is set to the incoming request unless fn sets it.
+func (q RoundTripQueue) ResponseFactory(fn func() *http.Response) RoundTripQueue {
+	q.roundTripFuncs = append(q.roundTripFuncs, func(req *http.Request) (*http.Response, error) {
+		res := fn()
+		if res == nil {
+			return nil, errors.New("ResponseFactory returned no response")
+		}
+		if res.Request == nil {
+			res.Request = req
+		}
+		return res, nil
+	})
+	return q
+}
+
+// ResponseByHeader selects the response by the request's header value for key.
+// The entry for "" is used as the default when no case matches; without it the round trip fails.
+// Like Response, it consumes a single queued response regardless of which case is selected.
+// The bodies of the cases are captured up front, as in ResponseRing, so each request gets a fresh copy.
+func (q RoundTripQueue) ResponseByHeader(key string, cases map[string]*http.Response) RoundTripQueue {
+	serves := make(map[string]func(*http.Request) (*http.Response, error), len(cases))
+	for value, res := range cases {
+		serves[value] = replayable(res)
+	}
+	q.roundTripFuncs = append(q.roundTripFuncs, func(req *http.Request) (*http.Response, error) {
+		value := req.Header.Get(key)
+		if serve, ok := serves[value]; ok {
+			return serve(req)
+		}
+		if serve, ok := serves[""]; ok {
+			return serve(req)
+		}
+		return nil, fmt.Errorf("no response for header %s: %q", key, value)
+	})
+	return q
+}
+
+// ResponseByLanguage returns the body in cases for the language preferred by the request's Accept-Language,
+// trying languages in order of quality. A tag such as "en-US" falls back to its primary language "en"
+// when it has no case of its own. def is returned when no language has a case.
+func (q RoundTripQueue) ResponseByLanguage(statusCode int, cases map[string]string, def string) RoundTripQueue {
+	q.roundTripFuncs = append(q.roundTripFuncs, func(req *http.Request) (*http.Response, error) {
+		body := def
+		if lang, ok := negotiateLanguage(req.Header.Get("Accept-Language"), cases); ok {
+			body = cases[lang]
+		}
+		body = normalizeBody(req, body)
+		return &http.Response{
+			StatusCode: statusCode,
+			Body:       io.NopCloser(strings.NewReader(body)),
+			Request:    req,
+		}, nil
+	})
+	return q
+}
+
+// ResponseError fails the round trip with err, e.g. io.ErrUnexpectedEOF to simulate a dropped connection.
+// http.Client wraps it in a *url.Error.
+func (q RoundTripQueue) ResponseError(err error) RoundTripQueue {
+	q.roundTripFuncs = append(q.roundTripFuncs, func(req *http.Request) (*http.Response, error) {
+		return nil, err
+	})
+	return q
+}
+
+// ResponseVaried returns a response with "Vary" listing the headers given to VaryOn and the body in cases for the
+// request's values of those headers, joined with "|" in VaryOn order (e.g. "gzip|en" for VaryOn("Accept-Encoding",
+// "Accept-Language")). The entry for "" is used as the default when no case matches; without it the round trip fails.
+// It panics if VaryOn has not been called before.
+func (q RoundTripQueue) ResponseVaried(statusCode int, cases map[string]string) RoundTripQueue {
+	if len(q.vary) == 0 {
+		panic("ResponseVaried called before VaryOn")
+	}
+	vary := q.vary
+	q.roundTripFuncs = append(q.roundTripFuncs, func(req *http.Request) (*http.Response, error) {
+		key := strings.Join(lo.Map(vary, func(h string, _ int) string { return req.Header.Get(h) }), "|")
+		body, ok := cases[key]
+		if !ok {
+			if body, ok = cases[""]; !ok {
+				return nil, fmt.Errorf("no response for %s: %q", strings.Join(vary, ", "), key)
+			}
+		}
+		return &http.Response{
+			StatusCode: statusCode,
+			Header:     http.Header{"Vary": []string{strings.Join(vary, ", ")}},
+			Body:       io.NopCloser(strings.NewReader(normalizeBody(req, body))),
+			Request:    req,
+		}, nil
+	})
+	return q
+}
+
+// ResponseDelayError waits for d and then fails the round trip with err.
+// If the request context is done first, the context error is returned instead.
+func (q RoundTripQueue) ResponseDelayError(d time.Duration, err error) RoundTripQueue {
+	q.roundTripFuncs = append(q.roundTripFuncs, func(req *http.Request) (*http.Response, error) {
+		if ctxErr := sleepContext(req.Context(), d); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, err
+	})
+	return q
+}
+
+// ResponseDNSError fails the round trip as if host could not be resolved, with the error
+// "dial tcp: lookup <host>: no such host" wrapping a *net.DNSError.
+func (q RoundTripQueue) ResponseDNSError(host string) RoundTripQueue {
+	q.roundTripFuncs = append(q.roundTripFuncs, func(req *http.Request) (*http.Response, error) {
+		return nil, &net.OpError{
+			Op:  "dial",
+			Net: "tcp",
+			Err: &net.DNSError{Err: "no such host", Name: host, IsNotFound: true},
+		}
+	})
+	return q
+}
+
+// ResponseHeaderDelay waits for d before returning the response, like a server that stalls before sending
+// headers, e.g. to exercise header timeouts. The body is not delayed. If the request context is done first,
+// the context error is returned instead.
+func (q RoundTripQueue) ResponseHeaderDelay(d time.Duration, statusCode int, body string) RoundTripQueue {
+	q.roundTripFuncs = append(q.roundTripFuncs, func(req *http.Request) (*http.Response, error) {
+		body := normalizeBody(req, body)
+		if err := sleepContext(req.Context(), d); err != nil {
+			return nil, err
+		}
+		return &http.Response{
+			StatusCode: statusCode,
+			Body:       io.NopCloser(strings.NewReader(body)),
+			Request:    req,
+		}, nil
+	})
+	return q
+}
+
+// ResponseDelayFunc delays every response of the queue by the duration delayFn returns for the request,
+// e.g. to make an earlier request complete after a later one. The delay is added to the transport's default delay.
+// If the request context is done first, the context error is returned instead.
+func (q RoundTripQueue) ResponseDelayFunc(delayFn func(*http.Request) time.Duration) RoundTripQueue {
+	q.delayFunc = delayFn
+	return q
+}
+
+// ResponseRing serves responses round-robin without consuming them, so the queue never runs dry.
+// Ring responses are not counted by Completed. The bodies are captured up front so that each
+// response can be served repeatedly.
+func (q RoundTripQueue) ResponseRing(responses ...*http.Response) RoundTripQueue {
+	for _, res := range responses {
+		q.ringFuncs = append(q.ringFuncs, replayable(res))
+	}
+	return q
+}
+
+// AlwaysResponseSimple serves statusCode and body for every matching request without being consumed,
+// e.g. for health checks. Persistent responses are served in rotation once the queued responses are exhausted,
+// so the queue always stays matchable, and like ResponseRing they do not keep Completed from returning true.
+func (q RoundTripQueue) AlwaysResponseSimple(statusCode int, body string) RoundTripQueue {
+	q.ringFuncs = append(q.ringFuncs, func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: statusCode,
+			Body:       io.NopCloser(strings.NewReader(normalizeBody(req, body))),
+			Request:    req,
+		}, nil
+	})
+	return q
+}
+
+// ResponseAlternateBody serves statusCode with the next of bodies on each matching request, starting over after
+// the last one, e.g. "", "full" to model a server that drops every other body. Like ResponseRing it is not
+// consumed, and it is not counted by Completed.
+func (q RoundTripQueue) ResponseAlternateBody(statusCode int, bodies ...string) RoundTripQueue {
+	return q.ringResponse(&alternateBody{statusCode: statusCode, bodies: bodies})
+}
+
+type alternateBody struct {
+	statusCode int
+	bodies     []string
+	mu         sync.Mutex
+	index      int
+}
+
+func (a *alternateBody) serve(req *http.Request) (*http.Response, error) {
+	if len(a.bodies) == 0 {
+		return nil, errors.New("ResponseAlternateBody has no bodies")
+	}
+	a.mu.Lock()
+	body := a.bodies[a.index%len(a.bodies)]
+	a.index++
+	a.mu.Unlock()
+	return &http.Response{
+		StatusCode: a.statusCode,
+		Body:       io.NopCloser(strings.NewReader(normalizeBody(req, body))),
+		Request:    req,
+	}, nil
+}
+
+func (a *alternateBody) copyState() ringState {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return &alternateBody{statusCode: a.statusCode, bodies: a.bodies, index: a.index}
+}
+
+// Fallback serves res indefinitely once the queued responses are exhausted, modeling
+// "N specific responses, then steady state". It is ResponseRing with a single response.
+func (q RoundTripQueue) Fallback(res *http.Response) RoundTripQueue {
+	return q.ResponseRing(res)
+}
+
+// ResponseMux routes matching requests through mux and returns what the handler records.
+// The queue only matches requests the mux has a handler for, and like ResponseRing it is never consumed.
+func (q RoundTripQueue) ResponseMux(mux *http.ServeMux) RoundTripQueue {
+	q.matchFuncs = append(q.matchFuncs, func(req *http.Request) (bool, error) {
+		_, pattern := mux.Handler(req)
+		return pattern != "", nil
+	})
+	q.ringFuncs = append(q.ringFuncs, func(req *http.Request) (*http.Response, error) {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		res := rec.Result()
+		res.Request = req
+		return res, nil
+	})
+	return q
+}
+
+// IdempotentResponse models a server honoring the Idempotency-Key header. The first request for a key
+// gets a response with statusCode and body; repeated requests with the same key get the same response
+// again with "Idempotent-Replayed: true". Like ResponseRing it is not consumed, and it is not counted by Completed.
+func (q RoundTripQueue) IdempotentResponse(statusCode int, body string) RoundTripQueue {
+	return q.ringResponse(&idempotentResponse{statusCode: statusCode, body: body, seen: map[string]bool{}})
+}
+
+type idempotentResponse struct {
+	statusCode int
+	body       string
+	mu         sync.Mutex
+	seen       map[string]bool
+}
+
+func (r *idempotentResponse) serve(req *http.Request) (*http.Response, error) {
+	res := &http.Response{
+		StatusCode: r.statusCode,
+		Header:     http.Header{},
+		Body:       io.NopCloser(strings.NewReader(normalizeBody(req, r.body))),
+		Request:    req,
+	}
+	key := req.Header.Get("Idempotency-Key")
+	if key == "" {
+		return res, nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.seen[key] {
+		res.Header.Set("Idempotent-Replayed", "true")
+	}
+	r.seen[key] = true
+	return res, nil
+}
+
+func (r *idempotentResponse) copyState() ringState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return &idempotentResponse{statusCode: r.statusCode, body: r.body, seen: maps.Clone(r.seen)}
+}
+
+// Times repeats the most recently queued response so that it is served for n matching requests in total,
+// e.g. ResponseSimple(200, "ok").Times(5). It panics if no response has been queued or n is less than 1.
+// Responses returning the same *http.Response, such as Response, should use ResponseFactory instead.
+func (q RoundTripQueue) Times(n int) RoundTripQueue {
+	if len(q.roundTripFuncs) == 0 {
+		panic("Times called before queueing a response")
+	}
+	if n < 1 {
+		panic(fmt.Sprintf("Times called with n = %d", n))
+	}
+	last := q.roundTripFuncs[len(q.roundTripFuncs)-1]
+	for i := 1; i < n; i++ {
+		q.roundTripFuncs = append(q.roundTripFuncs, last)
+	}
+	return q
+}
+
+// WithRequest sets the Request of the most recently queued response to r instead of the incoming request,
+// e.g. to simulate the final request of a redirect chain. It panics if no response has been queued.
+func (q RoundTripQueue) WithRequest(r *http.Request) RoundTripQueue {
+	return q.wrapLast("WithRequest", func(roundTrip func(*http.Request) (*http.Response, error)) func(*http.Request) (*http.Response, error) {
+		return func(req *http.Request) (*http.Response, error) {
+			res, err := roundTrip(req)
+			if err == nil && res != nil {
+				res.Request = r
+			}
+			return res, err
+		}
+	})
+}
+
+// Delay makes the most recently queued response wait for d before it is built, e.g. to trigger client timeouts.
+// If the request context is done first, the context error is returned instead. It panics if no response has been queued.
+func (q RoundTripQueue) Delay(d time.Duration) RoundTripQueue {
+	return q.wrapLast("Delay", func(roundTrip func(*http.Request) (*http.Response, error)) func(*http.Request) (*http.Response, error) {
+		return func(req *http.Request) (*http.Response, error) {
+			if err := sleepContext(req.Context(), d); err != nil {
+				return nil, err
+			}
+			return roundTrip(req)
+		}
+	})
+}
+
+// wrapLast replaces the most recently queued response func with wrap applied to it.
+// It panics, naming caller, if no response has been queued.
+func (q RoundTripQueue) wrapLast(caller string, wrap func(func(*http.Request) (*http.Response, error)) func(*http.Request) (*http.Response, error)) RoundTripQueue {
+	if len(q.roundTripFuncs) == 0 {
+		panic(caller + " called before queueing a response")
+	}
+	last := len(q.roundTripFuncs) - 1
+	// Clone so that queues derived from the same value keep their own response func
+	q.roundTripFuncs = slices.Clone(q.roundTripFuncs)
+	q.roundTripFuncs[last] = wrap(q.roundTripFuncs[last])
+	return q
+}
+
+// SucceedThenFail serves ok for the first n matched requests and fails every later one with failErr,
+// modeling a service that degrades. Like ResponseRing it is not consumed, and it is not counted by Completed.
+func (q RoundTripQueue) SucceedThenFail(n int, ok *http.Response, failErr error) RoundTripQueue {
+	return q.ringResponse(&succeedThenFail{n: n, ok: replayable(ok), failErr: failErr})
+}
+
+type succeedThenFail struct {
+	n       int
+	ok      func(*http.Request) (*http.Response, error)
+	failErr error
+	mu      sync.Mutex
+	calls   int
+}
+
+func (s *succeedThenFail) serve(req *http.Request) (*http.Response, error) {
+	s.mu.Lock()
+	s.calls++
+	succeed := s.calls <= s.n
+	s.mu.Unlock()
+	if !succeed {
+		return nil, s.failErr
+	}
+	return s.ok(req)
+}
+
+func (s *succeedThenFail) copyState() ringState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return &succeedThenFail{n: s.n, ok: s.ok, failErr: s.failErr, calls: s.calls}
+}
+
+func (q RoundTripQueue) ResponseFunc(roundTrip func(*http.Request) (*http.Response, error)) RoundTripQueue {
+	q.roundTripFuncs = append(q.roundTripFuncs, roundTrip)
+	return q
+}
+
+// ResponseForward delegates the matched request to rt, e.g. to reach a real server for this queue only.
+func (q RoundTripQueue) ResponseForward(rt http.RoundTripper) RoundTripQueue {
+	q.roundTripFuncs = append(q.roundTripFuncs, rt.RoundTrip)
+	return q
+}
+
+// ResponseStore runs fn, saves the value it returns in the transport's Store under key and returns its response.
+// The round trip fails if the request was not passed through a MockTransport, e.g. in DrainRemaining.
+func (q RoundTripQueue) ResponseStore(key string, fn func(*http.Request) (any, *http.Response, error)) RoundTripQueue {
+	q.roundTripFuncs = append(q.roundTripFuncs, func(req *http.Request) (*http.Response, error) {
+		store := StoreFrom(req)
+		if store == nil {
+			return nil, errors.New("ResponseStore needs a request served by a MockTransport")
+		}
+		value, res, err := fn(req)
+		if err != nil {
+			return nil, err
+		}
+		store.Set(key, value)
+		return res, nil
+	})
+	return q
+}
+
+// ResponseFromStore returns the value saved under key in the transport's Store as JSON,
+// or 404 Not Found if nothing is saved yet. Like ResponseStore, it fails for requests not passed through a MockTransport.
+func (q RoundTripQueue) ResponseFromStore(key string) RoundTripQueue {
+	q.roundTripFuncs = append(q.roundTripFuncs, func(req *http.Request) (*http.Response, error) {
+		store := StoreFrom(req)
+		if store == nil {
+			return nil, errors.New("ResponseFromStore needs a request served by a MockTransport")
+		}
+		value, ok := store.Get(key)
+		if !ok {
+			return &http.Response{StatusCode: http.StatusNotFound, Body: http.NoBody, Request: req}, nil
+		}
+		b, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(bytes.NewReader(b)),
+			Header:     http.Header{"Content-Type": []string{"application/json"}},
+			Request:    req,
+		}, nil
+	})
+	return q
+}
+
+// ResponseAssert is ResponseFunc with t in scope, so the request can be asserted where the response is built.
+// fn runs on the goroutine that calls RoundTrip; when the client runs on another goroutine
+// (e.g. parallel requests), report failures with t.Error rather than t.Fatal or t.FailNow.
+func (q RoundTripQueue) ResponseAssert(t testing.TB, fn func(t testing.TB, req *http.Request) *http.Response) RoundTripQueue {
+	q.roundTripFuncs = append(q.roundTripFuncs, func(req *http.Request) (*http.Response, error) {
+		t.Helper()
+		res := fn(t, req)
+		if res == nil {
+			return nil, errors.New("ResponseAssert returned no response")
+		}
+		return res, nil
+	})
+	return q
+}
+
+type requestLog struct {
+	matched     bool
+	passthrough bool
+	queueIndex  int
+	queueName   string
+	request     *http.Request
+	at          time.Time
+}
+
+func (l requestLog) String() string {
+	s := fmt.Sprintf("%s %s", l.request.Method, l.request.URL.String())
+	switch {
+	case l.passthrough:
+		s += " (passthrough)"
+	case !l.matched:
+		s += " (not matched)"
+	}
+	return s
+}
+
+type jsonRPCRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type jsonRPCResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *jsonRPCError   `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type jsonRPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// readJSONRPCRequest parses the request body as a JSON-RPC 2.0 request, restoring the body.
+// A missing id, as in notifications, is reported as null.
+func readJSONRPCRequest(req *http.Request) (jsonRPCRequest, error) {
+	body, err := peekBody(req)
+	if err != nil {
+		return jsonRPCRequest{}, err
+	}
+	var rpc jsonRPCRequest
+	if err := json.Unmarshal(body, &rpc); err != nil {
+		return jsonRPCRequest{}, err
+	}
+	if rpc.JSONRPC != "2.0" || rpc.Method == "" {
+		return jsonRPCRequest{}, errors.New("not a JSON-RPC 2.0 request")
+	}
+	if rpc.ID == nil {
+		rpc.ID = json.RawMessage("null")
+	}
+	return rpc, nil
+}
+
+// matcherLabel names a matcher after the function that created it, such as "Header" for the closure
+// "github.com/goro9/go-rtq.RoundTripQueue.Header.func1".
+func matcherLabel(f MatchFunc) string {
+	fn := runtime.FuncForPC(reflect.ValueOf(f).Pointer())
+	if fn == nil {
+		return "matcher"
+	}
+	name := fn.Name()
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	parts := strings.Split(name, ".")
+	// Drop the package and receiver type, and the suffixes of closures
+	parts = slices.DeleteFunc(parts[1:], func(p string) bool {
+		return p == "RoundTripQueue" || strings.HasPrefix(p, "func")
+	})
+	if len(parts) == 0 {
+		return "matcher"
+	}
+	return strings.Join(parts, ".")
+}
+
+type curlSpec struct {
+	method  string
+	url     *url.URL
+	headers [][2]string
+	data    *string
+}
+
+// curlValueFlags are the flags MatchCurl supports, which all take a value.
+var curlValueFlags = map[string]bool{
+	"-X": true, "--request": true,
+	"-H": true, "--header": true,
+	"-d": true, "--data": true, "--data-raw": true,
+}
+
+// curlBooleanFlags are flags without a value that do not change the request, so MatchCurl ignores them.
+var curlBooleanFlags = map[string]bool{
+	"-s": true, "--silent": true,
+	"-S": true, "--show-error": true,
+	"-L": true, "--location": true,
+	"-i": true, "--include": true,
+	"-k": true, "--insecure": true,
+	"-v": true, "--verbose": true,
+	"-f": true, "--fail": true,
+	"--compressed": true,
+}
+
+// parseCurl parses the supported subset of a cURL command described in MatchCurl.
+func parseCurl(curl string) (curlSpec, error) {
+	args, err := splitShellWords(curl)
+	if err != nil {
+		return curlSpec{}, err
+	}
+	if len(args) != 0 && args[0] == "curl" {
+		args = args[1:]
+	}
+	var spec curlSpec
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case !strings.HasPrefix(arg, "-"):
+			err = spec.setURL(arg)
+		case curlBooleanFlags[arg]:
+		case curlValueFlags[arg]:
+			if i+1 >= len(args) {
+				return curlSpec{}, fmt.Errorf("curl: missing value for %s", arg)
+			}
+			i++
+			err = spec.setFlag(arg, args[i])
+		default:
+			err = fmt.Errorf("curl: unsupported flag %s", arg)
+		}
+		if err != nil {
+			return curlSpec{}, err
+		}
+	}
+	if spec.url == nil {
+		return curlSpec{}, errors.New("curl: missing URL")
+	}
+	if spec.method == "" {
+		spec.method = http.MethodGet
+		if spec.data != nil {
+			spec.method = http.MethodPost
+		}
+	}
+	return spec, nil
+}
+
+// setURL sets the URL of the command, defaulting a URL without a scheme to http:// as cURL does.
+func (s *curlSpec) setURL(raw string) error {
+	if s.url != nil {
+		return fmt.Errorf("curl: multiple URLs: %q", raw)
+	}
+	if !strings.Contains(raw, "://") {
+		raw = "http://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("curl: %w", err)
+	}
+	s.url = u
+	return nil
+}
+
+// setFlag applies one of curlValueFlags with its value.
+func (s *curlSpec) setFlag(flag, value string) error {
+	switch flag {
+	case "-X", "--request":
+		s.method = value
+	case "-H", "--header":
+		key, v, found := strings.Cut(value, ":")
+		if !found {
+			return fmt.Errorf("curl: invalid header %q", value)
+		}
+		s.headers = append(s.headers, [2]string{strings.TrimSpace(key), strings.TrimSpace(v)})
+	default:
+		s.data = &value
+	}
+	return nil
+}
+
+// splitShellWords splits s into words like a POSIX shell, honoring single and double quotes,
+// backslash escapes and line continuations.
+func splitShellWords(s string) ([]string, error) {
+	var w shellWords
+	for _, r := range s {
+		w.next(r)
+	}
+	if w.quote != 0 || w.escaped {
+		return nil, errors.New("curl: unterminated quote or escape")
+	}
+	w.end()
+	return w.words, nil
+}
+
+// shellWords is the state of splitShellWords.
+type shellWords struct {
+	words   []string
+	word    strings.Builder
+	inWord  bool
+	quote   rune
+	escaped bool
+}
+
+func (w *shellWords) next(r rune) {
+	switch {
+	case w.escaped:
+		if r != '\n' {
+			w.add(r)
+		}
+		w.escaped = false
+	case w.quote == '\'':
+		w.quoted(r)
+	case r == '\\':
+		w.escaped = true
+	case w.quote == '"':
+		w.quoted(r)
+	case r == '\'' || r == '"':
+		w.quote = r
+		w.inWord = true
+	case unicode.IsSpace(r):
+		w.end()
+	default:
+		w.add(r)
+	}
+}
+
+// quoted handles r inside quotes, closing them at the matching quote.
+func (w *shellWords) quoted(r rune) {
+	if r == w.quote {
+		w.quote = 0
+		return
+	}
+	w.word.WriteRune(r)
+}
+
+func (w *shellWords) add(r rune) {
+	w.word.WriteRune(r)
+	w.inWord = true
+}
+
+// end finishes the current word, if any.
+func (w *shellWords) end() {
+	if w.inWord {
+		w.words = append(w.words, w.word.String())
+		w.word.Reset()
+		w.inWord = false
+	}
+}
+
+// jsonContains reports whether the decoded JSON value got contains want, as described in BodyJSONContains.
+func jsonContains(got, want any) bool {
+	switch want := want.(type) {
+	case map[string]any:
+		got, ok := got.(map[string]any)
+		if !ok {
+			return false
+		}
+		for key, w := range want {
+			g, ok := got[key]
+			if !ok || !jsonContains(g, w) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		got, ok := got.([]any)
+		if !ok || len(got) < len(want) {
+			return false
+		}
+		for i, w := range want {
+			if !jsonContains(got[i], w) {
+				return false
+			}
+		}
+		return true
+	default:
+		return reflect.DeepEqual(got, want)
+	}
+}
+
+// routeTemplate is a path template split into segments, where "{name}" and ":name" segments are params.
+type routeTemplate []string
+
+func parseRoute(template string) routeTemplate {
+	return strings.Split(template, "/")
+}
+
+// match reports whether path matches the template and returns the extracted params.
+func (r routeTemplate) match(path string) (map[string]string, bool) {
+	segments := strings.Split(path, "/")
+	if len(segments) != len(r) {
+		return nil, false
+	}
+	params := map[string]string{}
+	for i, segment := range r {
+		if name, ok := routeParam(segment); ok {
+			if segments[i] == "" {
+				return nil, false
+			}
+			params[name] = segments[i]
+			continue
+		}
+		if segment != segments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+// routeParam returns the param name of a "{name}" or ":name" template segment.
+func routeParam(segment string) (string, bool) {
+	if name, ok := strings.CutPrefix(segment, ":"); ok && name != "" {
+		return name, true
+	}
+	if name, ok := strings.CutPrefix(segment, "{"); ok && strings.HasSuffix(name, "}") {
+		return strings.TrimSuffix(name, "}"), true
+	}
+	return "", false
+}
+
+// replayable captures the body of res and returns a roundTrip serving a fresh copy of res on every call.
+// The body of res is replaced with an unread copy, so that res can be captured again, e.g. when the same
+// cases are passed to ResponseByHeader for several responses.
+func replayable(res *http.Response) func(*http.Request) (*http.Response, error) {
+	var body []byte
+	if res.Body != nil {
+		body = lo.Must1(io.ReadAll(res.Body))
+		_ = res.Body.Close()
+		res.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	return func(req *http.Request) (*http.Response, error) {
+		copied := *res
+		copied.Body = io.NopCloser(bytes.NewReader(body))
+		if copied.Request == nil {
+			copied.Request = req
+		}
+		return &copied, nil
+	}
+}
+
+// parseVersion parses a dotted numeric version such as "1.2.0", ignoring pre-release and build suffixes.
+func parseVersion(v string) ([]int, error) {
+	core, _, _ := strings.Cut(strings.TrimPrefix(v, "v"), "-")
+	core, _, _ = strings.Cut(core, "+")
+	parts := strings.Split(core, ".")
+	version := make([]int, 0, len(parts))
+	for _, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid version %q", v)
+		}
+		version = append(version, n)
+	}
+	return version, nil
+}
+
+func compareVersion(a, b []int) int {
+	for i := 0; i < max(len(a), len(b)); i++ {
+		x, y := 0, 0
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if x != y {
+			return cmp.Compare(x, y)
+		}
+	}
+	return 0
+}
+
+// acceptsGzip reports whether an Accept-Encoding header value accepts gzip with a non-zero quality.
+func acceptsGzip(acceptEncoding string) bool {
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		if quality, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(quality, 64); err == nil && v == 0 {
+				continue
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// negotiateLanguage returns the key of cases best matching an Accept-Language header value.
+// Tags are tried by descending quality, each exactly and then by its primary subtag, ignoring case.
+func negotiateLanguage(acceptLanguage string, cases map[string]string) (string, bool) {
+	lookup := func(tag string) (string, bool) {
+		for lang := range cases {
+			if strings.EqualFold(lang, tag) {
+				return lang, true
+			}
+		}
+		return "", false
+	}
+	for _, tag := range parseAcceptLanguage(acceptLanguage) {
+		if lang, ok := lookup(tag); ok {
+			return lang, true
+		}
+		if primary, _, found := strings.Cut(tag, "-"); found {
+			if lang, ok := lookup(primary); ok {
+				return lang, true
+			}
+		}
+	}
+	return "", false
+}
+
+// parseAcceptLanguage returns the language tags of an Accept-Language header value by descending quality.
+// The wildcard "*", tags with quality 0 and tags with a malformed quality are dropped.
+func parseAcceptLanguage(acceptLanguage string) []string {
+	type weighted struct {
+		tag     string
+		quality float64
+	}
+	var tags []weighted
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		quality := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			quality = parsed
+		}
+		if tag == "" || tag == "*" || quality <= 0 {
+			continue
+		}
+		tags = append(tags, weighted{tag: tag, quality: quality})
+	}
+	slices.SortStableFunc(tags, func(a, b weighted) int { return cmp.Compare(b.quality, a.quality) })
+	return lo.Map(tags, func(t weighted, _ int) string { return t.tag })
+}
+
+// peekBody reads the request body and restores it so that it can be read again.
+func peekBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil {
+		return nil, nil
+	}
+	got, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(got))
+	return got, nil
+}
+
+// sleepContext waits for d, returning early with the context error if ctx is done first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// significantHeaders returns a copy of h without the headers Go adds automatically.
+func significantHeaders(h http.Header) http.Header {
+	significant := h.Clone()
+	if significant == nil {
+		return http.Header{}
+	}
+	for _, key := range []string{"Host", "Content-Length", "Accept-Encoding"} {
+		significant.Del(key)
+	}
+	if ua := significant.Get("User-Agent"); strings.HasPrefix(ua, "Go-http-client/") {
+		significant.Del("User-Agent")
+	}
+	return significant
+}
+
+type sseReader struct {
+	ctx    context.Context
+	events []SSEvent
+	buf    []byte
+}
+
+func (r *sseReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if len(r.events) == 0 {
+			return 0, io.EOF
+		}
+		if err := sleepContext(r.ctx, r.events[0].Delay); err != nil {
+			return 0, err
+		}
+		r.buf = []byte(r.events[0].String())
+		r.events = r.events[1:]
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+type chanReader struct {
+	ctx context.Context
+	ch  <-chan []byte
+	buf []byte
+}
+
+func (r *chanReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		select {
+		case chunk, ok := <-r.ch:
+			if !ok {
+				return 0, io.EOF
+			}
+			r.buf = chunk
+		case <-r.ctx.Done():
+			return 0, r.ctx.Err()
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+type smallReader struct {
+	r         io.Reader
+	chunkSize int
+}
+
+func (r *smallReader) Read(p []byte) (int, error) {
+	if len(p) > r.chunkSize {
+		p = p[:r.chunkSize]
+	}
+	return r.r.Read(p)
+}
+
+// bodyRecorder is an io.Writer collecting bytes that may be read concurrently.
+type bodyRecorder struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (r *bodyRecorder) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.buf.Write(p)
+}
+
+func (r *bodyRecorder) Bytes() []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return bytes.Clone(r.buf.Bytes())
+}
+
+type teeReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+type closeErrorBody struct {
+	io.Reader
+	err error
+}
+
+func (b closeErrorBody) Close() error {
+	return b.err
 }
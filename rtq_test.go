@@ -1,11 +1,31 @@
 package rtq
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/samber/lo"
@@ -236,3 +256,2962 @@ func TestMockTransportParallel(t *testing.T) {
 	}
 	t.Log(mockTransport.RequestLogString())
 }
+
+func TestMockTransportDrainRemaining(t *testing.T) {
+	var mockTransport *MockTransport
+	mockTransport = NewTransport(
+		New("http://example.com").
+			ResponseSimple(200, "first").
+			ResponseJSON(201, map[string]int{"count": 1}),
+		New("http://example2.com").
+			ResponseFunc(func(req *http.Request) (*http.Response, error) {
+				return nil, fmt.Errorf("broken builder for %s", req.URL)
+			}),
+		// A func calling back into the transport must not deadlock
+		New("http://example3.com").Name("reentrant").
+			ResponseFunc(func(req *http.Request) (*http.Response, error) {
+				return &http.Response{StatusCode: 200 + mockTransport.RemainingFor("reentrant"), Body: http.NoBody}, nil
+			}),
+	)
+
+	responses := mockTransport.DrainRemaining()
+	if e, g := 4, len(responses); e != g {
+		t.Fatalf("unexpected drained length: expected %d, got %d", e, g)
+	}
+	if e, g := "first", string(lo.Must1(io.ReadAll(responses[0].Body))); e != g {
+		t.Errorf("unexpected body: expected %s, got %s", e, g)
+	}
+	if e, g := 201, responses[1].StatusCode; e != g {
+		t.Errorf("unexpected status: expected %d, got %d", e, g)
+	}
+	if responses[2] != nil {
+		t.Errorf("expected nil response for erroring builder")
+	}
+	if e, g := 200, responses[3].StatusCode; e != g {
+		t.Errorf("unexpected status: expected %d, got %d", e, g)
+	}
+	if !mockTransport.Completed() {
+		t.Errorf("mockTransport is not empty")
+	}
+}
+
+func TestMockTransportResponseCloseError(t *testing.T) {
+	closeErr := errors.New("close failed")
+	mockTransport := NewTransport(
+		New("http://example.com").
+			ResponseCloseError(200, "body", closeErr),
+	)
+	client := http.Client{Transport: mockTransport}
+
+	res := lo.Must1(client.Get("http://example.com/sample"))
+	if e, g := "body", string(lo.Must1(io.ReadAll(res.Body))); e != g {
+		t.Errorf("unexpected body: expected %s, got %s", e, g)
+	}
+	if err := res.Body.Close(); !errors.Is(err, closeErr) {
+		t.Errorf("unexpected close error: %v", err)
+	}
+}
+
+func TestMockTransportPreset(t *testing.T) {
+	authPreset := Preset(func(req *http.Request) (bool, error) {
+		return req.Header.Get("Authorization") == "Bearer test", nil
+	})
+	q := New("http://example.com")
+	mockTransport := NewTransport(
+		q.Use(authPreset).Get("/users").ResponseSimple(200, "users"),
+		q.Use(authPreset).Get("/posts").ResponseSimple(200, "posts"),
+	)
+	client := http.Client{Transport: mockTransport}
+
+	for _, path := range []string{"/users", "/posts"} {
+		req := lo.Must1(http.NewRequest("GET", "http://example.com"+path, nil))
+		if _, err := client.Do(req); err == nil {
+			t.Errorf("expected unauthenticated request to %s not to match", path)
+		}
+		req.Header.Set("Authorization", "Bearer test")
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e, g := path[1:], string(lo.Must1(io.ReadAll(res.Body))); e != g {
+			t.Errorf("unexpected body: expected %s, got %s", e, g)
+		}
+	}
+	// Only the unauthenticated requests are left unmatched, and every queued response was served
+	unmatched := lo.Map(mockTransport.UnmatchedRequests(), func(req *http.Request, _ int) string { return req.URL.Path })
+	if diff := cmp.Diff([]string{"/users", "/posts"}, unmatched); diff != "" {
+		t.Errorf("unexpected unmatched requests: %s", diff)
+	}
+	if e, g := 0, len(mockTransport.DrainRemaining()); e != g {
+		t.Errorf("unexpected remaining responses: expected %d, got %d", e, g)
+	}
+}
+
+func TestMockTransportResponseByHeader(t *testing.T) {
+	cases := map[string]*http.Response{
+		"1": {StatusCode: 200, Body: io.NopCloser(strings.NewReader("v1"))},
+		"2": {StatusCode: 200, Body: io.NopCloser(strings.NewReader("v2"))},
+	}
+	mockTransport := NewTransport(
+		New("http://example.com").
+			ResponseByHeader("X-API-Version", cases).
+			ResponseByHeader("X-API-Version", cases).
+			ResponseByHeader("X-API-Version", cases).
+			ResponseByHeader("X-API-Version", cases),
+	)
+	client := http.Client{Transport: mockTransport}
+
+	// The same case is selected twice, and both requests get its body
+	for _, version := range []string{"2", "2", "1"} {
+		req := lo.Must1(http.NewRequest("GET", "http://example.com/sample", nil))
+		req.Header.Set("X-API-Version", version)
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e, g := "v"+version, string(lo.Must1(io.ReadAll(res.Body))); e != g {
+			t.Errorf("unexpected body: expected %s, got %s", e, g)
+		}
+	}
+
+	req := lo.Must1(http.NewRequest("GET", "http://example.com/sample", nil))
+	req.Header.Set("X-API-Version", "3")
+	if _, err := client.Do(req); err == nil {
+		t.Errorf("expected error for unknown version without default")
+	}
+}
+
+func TestMockTransportHeadersExact(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").
+			HeadersExact(http.Header{"authorization": {"Bearer test"}}).
+			ResponseSimple(200, "ok"),
+	)
+	client := http.Client{Transport: mockTransport}
+
+	req := lo.Must1(http.NewRequest("GET", "http://example.com/sample", nil))
+	req.Header.Set("Authorization", "Bearer test")
+	req.Header.Set("X-Extra", "unexpected")
+	if _, err := client.Do(req); err == nil {
+		t.Errorf("expected request with extra header not to match")
+	}
+
+	req.Header.Del("X-Extra")
+	req.Header.Set("User-Agent", "Go-http-client/1.1")
+	req.Header.Set("Accept-Encoding", "gzip")
+	if _, err := client.Do(req); err != nil {
+		t.Errorf("expected request with only auto-added extras to match: %v", err)
+	}
+}
+
+func TestMockTransportResponseDelayError(t *testing.T) {
+	failErr := errors.New("connection reset")
+	mockTransport := NewTransport(
+		New("http://example.com").
+			ResponseDelayError(time.Second, failErr).
+			ResponseDelayError(10*time.Millisecond, failErr),
+	)
+	client := http.Client{Transport: mockTransport}
+
+	{
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		req := lo.Must1(http.NewRequestWithContext(ctx, "GET", "http://example.com/sample", nil))
+		if _, err := client.Do(req); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected context error, got %v", err)
+		}
+	}
+	{
+		req := lo.Must1(http.NewRequest("GET", "http://example.com/sample", nil))
+		if _, err := client.Do(req); !errors.Is(err, failErr) {
+			t.Errorf("expected injected error, got %v", err)
+		}
+	}
+}
+
+func TestMockTransportBodyRegex(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").
+			BodyRegex(`^hello, [a-z]+$`).
+			ResponseSimple(200, "ok"),
+		New("http://example2.com").
+			BodyRegex(`(`).
+			ResponseSimple(200, "ok"),
+	)
+	client := http.Client{Transport: mockTransport}
+
+	if _, err := client.Post("http://example.com/sample", "text/plain", strings.NewReader("hello, 123")); err == nil {
+		t.Errorf("expected non-matching body not to match")
+	}
+	if _, err := client.Post("http://example.com/sample", "text/plain", strings.NewReader("hello, world")); err != nil {
+		t.Errorf("expected matching body to match: %v", err)
+	}
+	if _, err := client.Post("http://example2.com/sample", "text/plain", strings.NewReader("hello")); err == nil || !strings.Contains(err.Error(), "missing closing )") {
+		t.Errorf("expected pattern compile error, got %v", err)
+	}
+}
+
+func TestMockTransportRequestLogEntries(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").
+			ResponseSimple(200, "general"),
+		New("http://example.com").Get("/specific").
+			ResponseSimple(200, "specific"),
+	)
+	client := http.Client{Transport: mockTransport}
+
+	for _, path := range []string{"/specific", "/specific", "/specific"} {
+		_, _ = client.Get("http://example.com" + path)
+	}
+
+	// The general queue is registered first, so it steals the first request.
+	got := lo.Map(mockTransport.RequestLogEntries(), func(e RequestLogEntry, _ int) int { return e.QueueIndex })
+	if diff := cmp.Diff([]int{0, 1, -1}, got); diff != "" {
+		t.Errorf("unexpected served queue indexes: %s", diff)
+	}
+}
+
+func TestMockTransportDefaultDelay(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").
+			ResponseSimple(200, "ok").
+			ResponseSimple(200, "ok"),
+	)
+	mockTransport.SetDefaultDelay(20 * time.Millisecond)
+	client := http.Client{Transport: mockTransport}
+
+	start := time.Now()
+	if _, err := client.Get("http://example.com/sample"); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("default delay not applied: elapsed %s", elapsed)
+	}
+
+	client.Timeout = 5 * time.Millisecond
+	if _, err := client.Get("http://example.com/sample"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestMockTransportRequestLine(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").
+			RequestLine("GET /sample?a=1 HTTP/1.1").
+			ResponseSimple(200, "ok"),
+	)
+
+	{
+		req := lo.Must1(http.NewRequest("GET", "http://example.com/sample?a=2", nil))
+		if _, err := mockTransport.RoundTrip(req); err == nil {
+			t.Errorf("expected different query not to match")
+		}
+	}
+	{
+		req := lo.Must1(http.NewRequest("GET", "http://example.com/sample?a=1", nil))
+		req.Proto = ""
+		if _, err := mockTransport.RoundTrip(req); err != nil {
+			t.Errorf("expected request line to match with default proto: %v", err)
+		}
+	}
+}
+
+func TestMockTransportResponseRing(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").
+			ResponseRing(
+				&http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader("a"))},
+				&http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader("b"))},
+			),
+	)
+	client := http.Client{Transport: mockTransport}
+
+	var got []string
+	for i := 0; i < 5; i++ {
+		res := lo.Must1(client.Get("http://example.com/sample"))
+		got = append(got, string(lo.Must1(io.ReadAll(res.Body))))
+	}
+	if diff := cmp.Diff([]string{"a", "b", "a", "b", "a"}, got); diff != "" {
+		t.Errorf("unexpected ring bodies: %s", diff)
+	}
+	if !mockTransport.Completed() {
+		t.Errorf("ring responses should not block Completed")
+	}
+}
+
+func TestMockTransportFork(t *testing.T) {
+	base := NewTransport(
+		New("http://example.com").
+			ResponseSimple(200, "ok"),
+	)
+
+	fork := base.Fork()
+	client := http.Client{Transport: fork}
+	if _, err := client.Get("http://example.com/sample"); err != nil {
+		t.Fatal(err)
+	}
+	if !fork.Completed() {
+		t.Errorf("fork is not empty")
+	}
+	if base.Completed() {
+		t.Errorf("parent should keep its response")
+	}
+	if e, g := 0, len(base.RequestLogEntries()); e != g {
+		t.Errorf("unexpected parent log length: expected %d, got %d", e, g)
+	}
+
+	// Transport-level settings are copied to the fork
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("real"))
+	}))
+	defer server.Close()
+
+	configured := NewTransport(
+		New("http://example.com").
+			ResponseSimple(200, "ok  \n"),
+	).WithPassthrough(server.Client().Transport)
+	configured.SetMaxRequests(2)
+	configured.SetResponseDecorator(func(req *http.Request, res *http.Response) *http.Response {
+		res.Header = http.Header{"X-Decorated": []string{"true"}}
+		return res
+	})
+	configured.NormalizeResponseBodies()
+	var verbose bytes.Buffer
+	configured.SetVerbose(&verbose)
+
+	client = http.Client{Transport: configured.Fork()}
+	res := lo.Must1(client.Get("http://example.com/sample"))
+	if e, g := "ok", string(lo.Must1(io.ReadAll(res.Body))); e != g {
+		t.Errorf("unexpected normalized body: expected %q, got %q", e, g)
+	}
+	if e, g := "true", res.Header.Get("X-Decorated"); e != g {
+		t.Errorf("unexpected decorated header: expected %q, got %q", e, g)
+	}
+	if verbose.Len() == 0 {
+		t.Errorf("expected the fork to write to the verbose writer")
+	}
+	res, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("expected the fork to pass through: %v", err)
+	}
+	if e, g := "real", string(lo.Must1(io.ReadAll(res.Body))); e != g {
+		t.Errorf("unexpected passthrough body: expected %q, got %q", e, g)
+	}
+	if _, err := client.Get("http://example.com/sample"); err == nil || !strings.Contains(err.Error(), "exceeded max requests (2)") {
+		t.Errorf("expected the fork to enforce max requests, got %v", err)
+	}
+}
+
+func TestMockTransportForkSucceedThenFail(t *testing.T) {
+	errOverloaded := errors.New("overloaded")
+	base := NewTransport(
+		New("http://example.com").
+			SucceedThenFail(1, &http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader("ok"))}, errOverloaded),
+	)
+
+	fork := base.Fork()
+	if _, err := (&http.Client{Transport: fork}).Get("http://example.com/sample"); err != nil {
+		t.Fatal(err)
+	}
+	// The fork's call does not count against the parent
+	client := http.Client{Transport: base}
+	if _, err := client.Get("http://example.com/sample"); err != nil {
+		t.Errorf("expected parent to succeed: %v", err)
+	}
+	if _, err := client.Get("http://example.com/sample"); !errors.Is(err, errOverloaded) {
+		t.Errorf("expected overloaded error, got %v", err)
+	}
+	// A fork taken now starts from the parent's call count
+	if _, err := (&http.Client{Transport: base.Fork()}).Get("http://example.com/sample"); !errors.Is(err, errOverloaded) {
+		t.Errorf("expected overloaded error from the later fork, got %v", err)
+	}
+}
+
+func TestMockTransportForkIdempotentResponse(t *testing.T) {
+	base := NewTransport(
+		New("http://example.com").
+			IdempotentResponse(201, "created"),
+	)
+	send := func(m *MockTransport) string {
+		req := lo.Must1(http.NewRequest("POST", "http://example.com/payments", nil))
+		req.Header.Set("Idempotency-Key", "key-1")
+		return lo.Must1(m.RoundTrip(req)).Header.Get("Idempotent-Replayed")
+	}
+
+	fork := base.Fork()
+	if g := send(fork); g != "" {
+		t.Errorf("unexpected replay on the fork's first request: %q", g)
+	}
+	if g := send(base); g != "" {
+		t.Errorf("key used on the fork was replayed on the parent: %q", g)
+	}
+	if e, g := "true", send(fork); e != g {
+		t.Errorf("unexpected Idempotent-Replayed on the fork: expected %q, got %q", e, g)
+	}
+}
+
+func TestMockTransportUserAgentAtLeast(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").
+			UserAgentAtLeast("myclient", "1.2.0").
+			ResponseSimple(200, "ok"),
+	)
+
+	for _, spec := range []struct {
+		UserAgent string
+		Match     bool
+	}{
+		{UserAgent: "myclient/1.1.9 (linux)", Match: false},
+		{UserAgent: "myclient/beta", Match: false},
+		{UserAgent: "", Match: false},
+		{UserAgent: "other/1.0 myclient/1.10", Match: true},
+	} {
+		req := lo.Must1(http.NewRequest("GET", "http://example.com/sample", nil))
+		req.Header.Set("User-Agent", spec.UserAgent)
+		_, err := mockTransport.RoundTrip(req)
+		if e, g := spec.Match, err == nil; e != g {
+			t.Errorf("unexpected match for %q: expected %t, got %t", spec.UserAgent, e, g)
+		}
+	}
+}
+
+func TestMockTransportSetMock(t *testing.T) {
+	mockTransport := NewTransport()
+	client := http.Client{Transport: mockTransport}
+
+	registered := lo.Must1(http.NewRequest("post", "http://example.com/sample?b=2&a=1", strings.NewReader("payload")))
+	mockTransport.SetMock(map[RequestHash]*http.Response{
+		lo.Must1(HashRequest(registered)): {StatusCode: 200, Body: io.NopCloser(strings.NewReader("hashed"))},
+	})
+
+	for i := 0; i < 2; i++ {
+		req := lo.Must1(http.NewRequest("POST", "http://example.com/sample?a=1&b=2", strings.NewReader("payload")))
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e, g := "hashed", string(lo.Must1(io.ReadAll(res.Body))); e != g {
+			t.Errorf("unexpected body: expected %s, got %s", e, g)
+		}
+	}
+
+	req := lo.Must1(http.NewRequest("POST", "http://example.com/sample?a=1&b=2", strings.NewReader("other")))
+	if _, err := client.Do(req); err == nil {
+		t.Errorf("expected different body not to match")
+	}
+}
+
+func TestMockTransportResponseSmallReads(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").
+			ResponseSmallReads(200, "0123456789", 3),
+	)
+	client := http.Client{Transport: mockTransport}
+
+	res := lo.Must1(client.Get("http://example.com/sample"))
+	var (
+		got   []byte
+		reads int
+	)
+	buf := make([]byte, 1024)
+	for {
+		n, err := res.Body.Read(buf)
+		if n > 0 {
+			reads++
+			got = append(got, buf[:n]...)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if e, g := "0123456789", string(got); e != g {
+		t.Errorf("unexpected body: expected %s, got %s", e, g)
+	}
+	if e, g := 4, reads; e != g {
+		t.Errorf("unexpected read count: expected %d, got %d", e, g)
+	}
+
+	for _, chunkSize := range []int{0, -1} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected chunkSize %d to panic", chunkSize)
+				}
+			}()
+			New("http://example.com").ResponseSmallReads(200, "body", chunkSize)
+		}()
+	}
+}
+
+func TestMockTransportAuthScheme(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").
+			AuthScheme("Bearer").
+			ResponseSimple(200, "ok").
+			ResponseSimple(200, "ok"),
+	)
+
+	for _, spec := range []struct {
+		Authorization string
+		Match         bool
+	}{
+		{Authorization: "Bearer token-a", Match: true},
+		{Authorization: "Bearer token-b", Match: true},
+		{Authorization: "Basic dXNlcjpwYXNz", Match: false},
+		{Authorization: "Bearer", Match: false},
+	} {
+		req := lo.Must1(http.NewRequest("GET", "http://example.com/sample", nil))
+		req.Header.Set("Authorization", spec.Authorization)
+		_, err := mockTransport.RoundTrip(req)
+		if e, g := spec.Match, err == nil; e != g {
+			t.Errorf("unexpected match for %q: expected %t, got %t", spec.Authorization, e, g)
+		}
+	}
+}
+
+func TestMockTransportResponseStatus(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").
+			ResponseStatus(500),
+	)
+	client := http.Client{Transport: mockTransport}
+
+	res := lo.Must1(client.Get("http://example.com/sample"))
+	if e, g := "500 Internal Server Error", res.Status; e != g {
+		t.Errorf("unexpected status: expected %s, got %s", e, g)
+	}
+	if e, g := "", string(lo.Must1(io.ReadAll(res.Body))); e != g {
+		t.Errorf("unexpected body: expected %q, got %q", e, g)
+	}
+}
+
+func TestMockTransportIdempotentResponse(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").Post("/payments").
+			IdempotentResponse(201, `{"id":"pay_1"}`),
+	)
+	client := http.Client{Transport: mockTransport}
+
+	type result struct {
+		Status   int
+		Body     string
+		Replayed string
+	}
+	send := func(key string) result {
+		req := lo.Must1(http.NewRequest("POST", "http://example.com/payments", strings.NewReader("{}")))
+		req.Header.Set("Idempotency-Key", key)
+		res := lo.Must1(client.Do(req))
+		return result{
+			Status:   res.StatusCode,
+			Body:     string(lo.Must1(io.ReadAll(res.Body))),
+			Replayed: res.Header.Get("Idempotent-Replayed"),
+		}
+	}
+
+	first := send("key-1")
+	second := send("key-1")
+	if diff := cmp.Diff(result{Status: 201, Body: `{"id":"pay_1"}`}, first); diff != "" {
+		t.Errorf("unexpected first response: %s", diff)
+	}
+	if diff := cmp.Diff(result{Status: 201, Body: `{"id":"pay_1"}`, Replayed: "true"}, second); diff != "" {
+		t.Errorf("unexpected replayed response: %s", diff)
+	}
+	if g := send("key-2"); g.Replayed != "" {
+		t.Errorf("new key should not be replayed")
+	}
+}
+
+func TestMockTransportResponseAutoCompress(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").
+			ResponseAutoCompress(200, "hello").
+			ResponseAutoCompress(200, "hello"),
+	)
+	client := http.Client{Transport: mockTransport}
+
+	{
+		req := lo.Must1(http.NewRequest("GET", "http://example.com/sample", nil))
+		req.Header.Set("Accept-Encoding", "br, gzip;q=0.8")
+		res := lo.Must1(client.Do(req))
+		if e, g := "gzip", res.Header.Get("Content-Encoding"); e != g {
+			t.Errorf("unexpected Content-Encoding: expected %s, got %s", e, g)
+		}
+		zr := lo.Must1(gzip.NewReader(res.Body))
+		if e, g := "hello", string(lo.Must1(io.ReadAll(zr))); e != g {
+			t.Errorf("unexpected body: expected %s, got %s", e, g)
+		}
+	}
+	{
+		req := lo.Must1(http.NewRequest("GET", "http://example.com/sample", nil))
+		res := lo.Must1(client.Do(req))
+		if e, g := "", res.Header.Get("Content-Encoding"); e != g {
+			t.Errorf("unexpected Content-Encoding: expected %q, got %q", e, g)
+		}
+		if e, g := "hello", string(lo.Must1(io.ReadAll(res.Body))); e != g {
+			t.Errorf("unexpected body: expected %s, got %s", e, g)
+		}
+	}
+}
+
+func TestMockTransportTree(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").Get("/users").
+			ResponseSimple(200, "[]").
+			ResponseSimple(200, "[]"),
+		New("http://example2.com").
+			ResponseSimple(200, "ok"),
+		New("http://example.com").Post("/users").
+			ResponseRing(&http.Response{StatusCode: 201, Body: http.NoBody}),
+	)
+
+	expect := `http://example.com
+  queue 0: matchers=3 remaining=2
+  queue 2: matchers=3 remaining=0 ring=1
+http://example2.com
+  queue 1: matchers=1 remaining=1
+`
+	if diff := cmp.Diff(expect, mockTransport.Tree()); diff != "" {
+		t.Errorf("unexpected tree: %s", diff)
+	}
+}
+
+func TestMockTransportBodyJSONArrayLen(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").
+			BodyJSONArrayLen(3).
+			ResponseSimple(200, "ok"),
+	)
+
+	for _, spec := range []struct {
+		Body  string
+		Match bool
+	}{
+		{Body: `[1, {"a": 2}, [3]]`, Match: true},
+		{Body: `[1, 2]`, Match: false},
+		{Body: `{"items": [1, 2, 3]}`, Match: false},
+		{Body: `null`, Match: false},
+	} {
+		req := lo.Must1(http.NewRequest("POST", "http://example.com/batch", strings.NewReader(spec.Body)))
+		_, err := mockTransport.RoundTrip(req)
+		if e, g := spec.Match, err == nil; e != g {
+			t.Errorf("unexpected match for %s: expected %t, got %t", spec.Body, e, g)
+		}
+	}
+}
+
+func TestMockTransportResponseAssert(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").Post("/users").
+			ResponseAssert(t, func(t testing.TB, req *http.Request) *http.Response {
+				if e, g := "application/json", req.Header.Get("Content-Type"); e != g {
+					t.Errorf("unexpected Content-Type: expected %s, got %s", e, g)
+				}
+				return &http.Response{StatusCode: 201, Body: http.NoBody, Request: req}
+			}),
+	)
+	client := http.Client{Transport: mockTransport}
+
+	res, err := client.Post("http://example.com/users", "application/json", strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := 201, res.StatusCode; e != g {
+		t.Errorf("unexpected status: expected %d, got %d", e, g)
+	}
+}
+
+func TestMockTransportResponseSSE(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").
+			ResponseSSE(
+				SSEvent{ID: "1", Event: "greeting", Data: "hello"},
+				SSEvent{Data: "multi\nline", Delay: 10 * time.Millisecond},
+			),
+	)
+	client := http.Client{Transport: mockTransport}
+
+	start := time.Now()
+	res := lo.Must1(client.Get("http://example.com/events"))
+	if e, g := "text/event-stream", res.Header.Get("Content-Type"); e != g {
+		t.Errorf("unexpected Content-Type: expected %s, got %s", e, g)
+	}
+
+	type event struct {
+		ID, Event string
+		Data      []string
+	}
+	var (
+		events  []event
+		current event
+	)
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		field, value, _ := strings.Cut(scanner.Text(), ": ")
+		switch field {
+		case "id":
+			current.ID = value
+		case "event":
+			current.Event = value
+		case "data":
+			current.Data = append(current.Data, value)
+		case "":
+			events = append(events, current)
+			current = event{}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	expect := []event{
+		{ID: "1", Event: "greeting", Data: []string{"hello"}},
+		{Data: []string{"multi", "line"}},
+	}
+	if diff := cmp.Diff(expect, events); diff != "" {
+		t.Errorf("unexpected events: %s", diff)
+	}
+	if elapsed := time.Since(start); elapsed < 10*time.Millisecond {
+		t.Errorf("event delay not applied: elapsed %s", elapsed)
+	}
+
+	// An event without Data still has a data line so that clients dispatch it
+	if e, g := "event: ping\ndata: \n\n", (SSEvent{Event: "ping"}).String(); e != g {
+		t.Errorf("unexpected event: expected %q, got %q", e, g)
+	}
+}
+
+func TestMockTransportHostHeader(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://10.0.0.1").
+			HostHeader("api.example.com").
+			ResponseSimple(200, "ok"),
+	)
+
+	{
+		req := lo.Must1(http.NewRequest("GET", "http://10.0.0.1/sample", nil))
+		if _, err := mockTransport.RoundTrip(req); err == nil {
+			t.Errorf("expected URL host not to match")
+		}
+	}
+	{
+		req := lo.Must1(http.NewRequest("GET", "http://10.0.0.1/sample", nil))
+		req.Host = "api.example.com"
+		if _, err := mockTransport.RoundTrip(req); err != nil {
+			t.Errorf("expected Host header to match: %v", err)
+		}
+	}
+}
+
+func TestMockTransportStore(t *testing.T) {
+	q := New("http://example.com")
+	mockTransport := NewTransport(
+		q.Post("/users").
+			ResponseStore("user", func(req *http.Request) (any, *http.Response, error) {
+				var user map[string]any
+				if err := json.NewDecoder(req.Body).Decode(&user); err != nil {
+					return nil, nil, err
+				}
+				user["id"] = 1
+				return user, &http.Response{StatusCode: 201, Body: http.NoBody, Request: req}, nil
+			}),
+		q.Get("/users/1").
+			ResponseFromStore("user").
+			ResponseFromStore("user"),
+	)
+	client := http.Client{Transport: mockTransport}
+
+	if res := lo.Must1(client.Get("http://example.com/users/1")); res.StatusCode != 404 {
+		t.Errorf("expected 404 before create, got %d", res.StatusCode)
+	}
+	if res := lo.Must1(client.Post("http://example.com/users", "application/json", strings.NewReader(`{"name":"alice"}`))); res.StatusCode != 201 {
+		t.Errorf("expected 201 on create, got %d", res.StatusCode)
+	}
+	res := lo.Must1(client.Get("http://example.com/users/1"))
+	if diff := cmp.Diff(`{"id":1,"name":"alice"}`, string(lo.Must1(io.ReadAll(res.Body)))); diff != "" {
+		t.Errorf("unexpected stored user: %s", diff)
+	}
+	if _, ok := mockTransport.Store().Get("user"); !ok {
+		t.Errorf("expected user in store")
+	}
+}
+
+func TestMockTransportStoreWithoutTransport(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").
+			ResponseStore("user", func(req *http.Request) (any, *http.Response, error) {
+				return "alice", &http.Response{StatusCode: 201, Body: http.NoBody, Request: req}, nil
+			}).
+			ResponseFromStore("user"),
+	)
+
+	// DrainRemaining calls the response funcs with a request that was not served by the transport
+	responses := mockTransport.DrainRemaining()
+	if diff := cmp.Diff([]*http.Response{nil, nil}, responses); diff != "" {
+		t.Errorf("expected nil responses for store-backed funcs: %s", diff)
+	}
+	if _, ok := mockTransport.Store().Get("user"); ok {
+		t.Errorf("expected nothing in store")
+	}
+}
+
+func TestMockTransportServerName(t *testing.T) {
+	mockTransport := NewTransport(
+		New("https://example.com").
+			ServerName("api.example.com").
+			ResponseSimple(200, "ok"),
+	)
+
+	{
+		req := lo.Must1(http.NewRequest("GET", "https://example.com/sample", nil))
+		if _, err := mockTransport.RoundTrip(req); err == nil {
+			t.Errorf("expected request without TLS state not to match")
+		}
+	}
+	{
+		req := lo.Must1(http.NewRequest("GET", "https://example.com/sample", nil))
+		req.TLS = &tls.ConnectionState{ServerName: "api.example.com"}
+		if _, err := mockTransport.RoundTrip(req); err != nil {
+			t.Errorf("expected server name to match: %v", err)
+		}
+	}
+}
+
+func TestMockTransportMaxConcurrency(t *testing.T) {
+	const concurrency = 5
+	var arrived sync.WaitGroup
+	arrived.Add(concurrency)
+	queue := New("http://example.com")
+	for i := 0; i < concurrency; i++ {
+		queue = queue.ResponseFunc(func(req *http.Request) (*http.Response, error) {
+			// Hold every request until all of them are in flight.
+			arrived.Done()
+			arrived.Wait()
+			return &http.Response{StatusCode: 200, Body: http.NoBody, Request: req}, nil
+		})
+	}
+	mockTransport := NewTransport(queue)
+	client := http.Client{Transport: mockTransport}
+
+	_ = lop.Times(concurrency, func(i int) error {
+		_, err := client.Get(fmt.Sprintf("http://example.com/request%d", i))
+		return err
+	})
+
+	if e, g := concurrency, mockTransport.MaxConcurrency(); e != g {
+		t.Errorf("unexpected max concurrency: expected %d, got %d", e, g)
+	}
+}
+
+func TestMockTransportResponseJSONP(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").
+			ResponseJSONP(200, "cb", map[string]int{"count": 1}),
+	)
+	client := http.Client{Transport: mockTransport}
+
+	res := lo.Must1(client.Get("http://example.com/legacy?cb=handleCount"))
+	if e, g := `handleCount({"count":1});`, string(lo.Must1(io.ReadAll(res.Body))); e != g {
+		t.Errorf("unexpected body: expected %s, got %s", e, g)
+	}
+	if e, g := "application/javascript", res.Header.Get("Content-Type"); e != g {
+		t.Errorf("unexpected Content-Type: expected %s, got %s", e, g)
+	}
+}
+
+func TestMockTransportQuerySingleValue(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").
+			QuerySingleValue("id").
+			ResponseSimple(200, "ok"),
+	)
+
+	for _, spec := range []struct {
+		URL   string
+		Match bool
+	}{
+		{URL: "http://example.com/sample?id=1&id=2", Match: false},
+		{URL: "http://example.com/sample", Match: false},
+		{URL: "http://example.com/sample?id=1", Match: true},
+	} {
+		req := lo.Must1(http.NewRequest("GET", spec.URL, nil))
+		_, err := mockTransport.RoundTrip(req)
+		if e, g := spec.Match, err == nil; e != g {
+			t.Errorf("unexpected match for %s: expected %t, got %t", spec.URL, e, g)
+		}
+	}
+}
+
+func TestMockTransportResponseRawHeaders(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").
+			ResponseRawHeaders(200, "ok", "x-custom-ID: 1", "x-custom-ID: 2", "ETag: abc"),
+	)
+	client := http.Client{Transport: mockTransport}
+
+	res := lo.Must1(client.Get("http://example.com/sample"))
+	expect := http.Header{
+		"x-custom-ID": {"1", "2"},
+		"ETag":        {"abc"},
+	}
+	if diff := cmp.Diff(expect, res.Header); diff != "" {
+		t.Errorf("unexpected headers: %s", diff)
+	}
+}
+
+func TestMockTransportOriginGroup(t *testing.T) {
+	mockTransport := NewTransport().
+		Origin("http://example.com").
+		Get("/users", func(q RoundTripQueue) RoundTripQueue { return q.ResponseSimple(200, "list") }).
+		Post("/users", func(q RoundTripQueue) RoundTripQueue { return q.ResponseSimple(201, "created") }).
+		Delete("/users/1", func(q RoundTripQueue) RoundTripQueue { return q.ResponseSimple(204, "") }).
+		Done()
+	client := http.Client{Transport: mockTransport}
+
+	for _, spec := range []struct {
+		Method string
+		Path   string
+		Status int
+	}{
+		{Method: "POST", Path: "/users", Status: 201},
+		{Method: "GET", Path: "/users", Status: 200},
+		{Method: "DELETE", Path: "/users/1", Status: 204},
+	} {
+		req := lo.Must1(http.NewRequest(spec.Method, "http://example.com"+spec.Path, nil))
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e, g := spec.Status, res.StatusCode; e != g {
+			t.Errorf("unexpected status for %s %s: expected %d, got %d", spec.Method, spec.Path, e, g)
+		}
+	}
+	if !mockTransport.Completed() {
+		t.Errorf("mockTransport is not empty")
+	}
+}
+
+func TestMockTransportResponseMux(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/users", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "users")
+	})
+	mux.HandleFunc("/posts/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		_, _ = io.WriteString(w, "post "+strings.TrimPrefix(r.URL.Path, "/posts/"))
+	})
+	mockTransport := NewTransport(
+		New("http://example.com").
+			ResponseMux(mux),
+	)
+	client := http.Client{Transport: mockTransport}
+
+	for _, spec := range []struct {
+		Path   string
+		Status int
+		Body   string
+	}{
+		{Path: "/users", Status: 200, Body: "users"},
+		{Path: "/posts/42", Status: 202, Body: "post 42"},
+		{Path: "/users", Status: 200, Body: "users"},
+	} {
+		res := lo.Must1(client.Get("http://example.com" + spec.Path))
+		got := []any{res.StatusCode, string(lo.Must1(io.ReadAll(res.Body)))}
+		if diff := cmp.Diff([]any{spec.Status, spec.Body}, got); diff != "" {
+			t.Errorf("unexpected response for %s: %s", spec.Path, diff)
+		}
+	}
+	if _, err := client.Get("http://example.com/unknown"); err == nil {
+		t.Errorf("expected unrouted path not to match")
+	}
+}
+
+func TestMockTransportWithinTimeWindow(t *testing.T) {
+	now := time.Now()
+	mockTransport := NewTransport(
+		New("http://example.com").WithinTimeWindow(now.Add(-time.Hour), now.Add(-time.Minute)).
+			ResponseSimple(200, "past"),
+		New("http://example.com").WithinTimeWindow(now, now.Add(time.Hour)).
+			ResponseSimple(200, "current"),
+	)
+
+	matched := lo.Must1(http.NewRequest("GET", "http://example.com/sample", nil))
+	res := lo.Must1(mockTransport.RoundTrip(matched))
+	if e, g := "current", string(lo.Must1(io.ReadAll(res.Body))); e != g {
+		t.Errorf("unexpected body: expected %s, got %s", e, g)
+	}
+	unmatched := lo.Must1(http.NewRequest("GET", "http://example.com/sample", nil))
+	if _, err := mockTransport.RoundTrip(unmatched); err == nil {
+		t.Errorf("expected request outside the past window not to match")
+	}
+	entries := mockTransport.RequestLogEntries()
+	if at := entries[0].Time; at.Before(now) || at.After(now.Add(time.Hour)) {
+		t.Errorf("unexpected logged time: %s", at)
+	}
+
+	// Stamping the time does not replace the caller's request
+	if res.Request != matched || entries[0].Request != matched {
+		t.Errorf("expected the caller's request in the response and the log")
+	}
+	if g := mockTransport.UnmatchedRequests(); len(g) != 1 || g[0] != unmatched {
+		t.Errorf("expected the caller's request in the unmatched requests")
+	}
+}
+
+func TestMockTransportQueryRegex(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").QueryRegex("id", `^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`).
+			ResponseSimple(200, "ok").
+			ResponseSimple(200, "ok"),
+	)
+
+	for _, spec := range []struct {
+		URL   string
+		Match bool
+	}{
+		{URL: "http://example.com/sample?id=123e4567-e89b-12d3-a456-426614174000", Match: true},
+		{URL: "http://example.com/sample?id=123e4567-e89b-12d3-a456", Match: false},
+		{URL: "http://example.com/sample", Match: false},
+	} {
+		req := lo.Must1(http.NewRequest("GET", spec.URL, nil))
+		_, err := mockTransport.RoundTrip(req)
+		if e, g := spec.Match, err == nil; e != g {
+			t.Errorf("unexpected match for %s: expected %t, got %t", spec.URL, e, g)
+		}
+	}
+
+	req := lo.Must1(http.NewRequest("GET", "http://example.com/sample?id=1", nil))
+	if _, err := NewTransport(New("http://example.com").QueryRegex("id", "(").ResponseSimple(200, "ok")).RoundTrip(req); err == nil {
+		t.Errorf("expected invalid pattern error")
+	}
+}
+
+func TestMockTransportResponseDNSError(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").
+			ResponseDNSError("example.com"),
+	)
+	client := http.Client{Transport: mockTransport}
+
+	_, err := client.Get("http://example.com/sample")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) {
+		t.Fatalf("expected *net.DNSError, got %v", err)
+	}
+	if !dnsErr.IsNotFound || dnsErr.Name != "example.com" {
+		t.Errorf("unexpected DNS error: %+v", dnsErr)
+	}
+	if diff := cmp.Diff(`Get "http://example.com/sample": dial tcp: lookup example.com: no such host`, err.Error()); diff != "" {
+		t.Errorf("unexpected error: %s", diff)
+	}
+}
+
+func TestMockTransportLastResponseBody(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").
+			ResponseSimple(200, "first").
+			ResponseSimple(200, "second"),
+	)
+	client := http.Client{Transport: mockTransport}
+	mockTransport.EnableResponseCapture()
+
+	if got := mockTransport.LastResponseBody(); got != nil {
+		t.Errorf("unexpected body before any response: %q", got)
+	}
+	for _, expect := range []string{"first", "second"} {
+		res := lo.Must1(client.Get("http://example.com/sample"))
+		body := string(lo.Must1(io.ReadAll(res.Body)))
+		if e, g := expect, body; e != g {
+			t.Errorf("unexpected body read by client: expected %s, got %s", e, g)
+		}
+		if e, g := expect, string(mockTransport.LastResponseBody()); e != g {
+			t.Errorf("unexpected last response body: expected %s, got %s", e, g)
+		}
+	}
+
+	// Empty and writable bodies are served as is
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	mockTransport = NewTransport(
+		New("http://example.com").
+			Response(&http.Response{StatusCode: 204, Body: http.NoBody}).
+			Response(&http.Response{StatusCode: 101, Body: conn}),
+	)
+	mockTransport.EnableResponseCapture()
+	if res := lo.Must1(mockTransport.RoundTrip(lo.Must1(http.NewRequest("GET", "http://example.com/sample", nil)))); res.Body != http.NoBody {
+		t.Errorf("expected http.NoBody, got %T", res.Body)
+	}
+	if res := lo.Must1(mockTransport.RoundTrip(lo.Must1(http.NewRequest("GET", "http://example.com/upgrade", nil)))); res.Body != conn {
+		t.Errorf("expected the writable body, got %T", res.Body)
+	}
+}
+
+func TestMockTransportHeaderAbsent(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").HeaderAbsent("Authorization").
+			ResponseSimple(200, "ok").
+			ResponseSimple(200, "ok"),
+	)
+
+	for _, spec := range []struct {
+		Header http.Header
+		Match  bool
+	}{
+		{Header: http.Header{"Authorization": {"Bearer secret"}}, Match: false},
+		{Header: http.Header{"Authorization": {""}}, Match: false},
+		{Header: http.Header{"Accept": {"*/*"}}, Match: true},
+		{Header: nil, Match: true},
+	} {
+		req := lo.Must1(http.NewRequest("GET", "http://example.com/sample", nil))
+		req.Header = spec.Header
+		_, err := mockTransport.RoundTrip(req)
+		if e, g := spec.Match, err == nil; e != g {
+			t.Errorf("unexpected match for %v: expected %t, got %t", spec.Header, e, g)
+		}
+	}
+}
+
+func TestMockTransportResponseFromDump(t *testing.T) {
+	dump := "HTTP/1.1 201 Created\r\n" +
+		"Content-Type: application/json\r\n" +
+		"Content-Length: 11\r\n" +
+		"\r\n" +
+		`{"id": 42}` + "\n"
+	mockTransport := NewTransport(
+		New("http://example.com").
+			ResponseFromDump([]byte(dump)),
+	)
+	client := http.Client{Transport: mockTransport}
+
+	res := lo.Must1(client.Get("http://example.com/sample"))
+	got := []any{res.StatusCode, res.Header.Get("Content-Type"), string(lo.Must1(io.ReadAll(res.Body)))}
+	if diff := cmp.Diff([]any{201, "application/json", `{"id": 42}` + "\n"}, got); diff != "" {
+		t.Errorf("unexpected response: %s", diff)
+	}
+	if res.Request == nil || res.Request.URL.Path != "/sample" {
+		t.Errorf("expected response to carry the request")
+	}
+}
+
+func TestMockTransportPause(t *testing.T) {
+	const n = 3
+	mockTransport := NewTransport(
+		New("http://example.com").
+			ResponseRing(&http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader("ok"))}),
+	)
+	client := http.Client{Transport: mockTransport}
+
+	mockTransport.Pause()
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := client.Get("http://example.com/sample")
+			errs <- err
+		}()
+	}
+
+	// Wait until every request is blocked in the transport
+	for deadline := time.Now().Add(time.Second); mockTransport.MaxConcurrency() < n; {
+		if time.Now().After(deadline) {
+			t.Fatalf("requests did not reach the transport: %d in flight", mockTransport.MaxConcurrency())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if got := len(mockTransport.RequestLogEntries()); got != 0 {
+		t.Errorf("expected no request to be served while paused, got %d", got)
+	}
+
+	mockTransport.Resume()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+
+	mockTransport.Pause()
+	client.Timeout = 5 * time.Millisecond
+	if _, err := client.Get("http://example.com/sample"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded while paused, got %v", err)
+	}
+}
+
+func TestMockTransportHeaderCount(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").HeaderCount(2).
+			ResponseSimple(200, "ok").
+			ResponseSimple(200, "ok"),
+	)
+	client := http.Client{Transport: mockTransport}
+
+	for _, spec := range []struct {
+		Header http.Header
+		Match  bool
+	}{
+		{Header: http.Header{"Accept": {"*/*"}, "X-Trace": {"1"}, "X-Extra": {"1"}}, Match: false},
+		{Header: http.Header{"Accept": {"*/*"}, "X-Trace": {"1", "2"}}, Match: true},
+	} {
+		req := lo.Must1(http.NewRequest("GET", "http://example.com/sample", nil))
+		req.Header = spec.Header
+		_, err := client.Do(req)
+		if e, g := spec.Match, err == nil; e != g {
+			t.Errorf("unexpected match for %v: expected %t, got %t", spec.Header, e, g)
+		}
+	}
+}
+
+func TestMockTransportResponseForward(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "real "+r.URL.Path)
+	}))
+	defer srv.Close()
+	mockTransport := NewTransport(
+		New(srv.URL).Get("/real").
+			ResponseForward(srv.Client().Transport),
+		New(srv.URL).Get("/stub").
+			ResponseSimple(200, "stub"),
+	)
+	client := http.Client{Transport: mockTransport}
+
+	for _, spec := range []struct {
+		Path string
+		Body string
+	}{
+		{Path: "/real", Body: "real /real"},
+		{Path: "/stub", Body: "stub"},
+	} {
+		res := lo.Must1(client.Get(srv.URL + spec.Path))
+		if e, g := spec.Body, string(lo.Must1(io.ReadAll(res.Body))); e != g {
+			t.Errorf("unexpected body for %s: expected %s, got %s", spec.Path, e, g)
+		}
+		_ = res.Body.Close()
+	}
+	if !mockTransport.Completed() {
+		t.Errorf("mockTransport is not empty")
+	}
+}
+
+func TestMockTransportMethodInsensitive(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").MethodInsensitive("GET").
+			ResponseSimple(200, "ok").
+			ResponseSimple(200, "ok"),
+	)
+
+	for _, spec := range []struct {
+		Method string
+		Match  bool
+	}{
+		{Method: "get", Match: true},
+		{Method: "post", Match: false},
+		{Method: "GET", Match: true},
+	} {
+		req := lo.Must1(http.NewRequest(spec.Method, "http://example.com/sample", nil))
+		_, err := mockTransport.RoundTrip(req)
+		if e, g := spec.Match, err == nil; e != g {
+			t.Errorf("unexpected match for %s: expected %t, got %t", spec.Method, e, g)
+		}
+	}
+}
+
+func TestMockTransportResponseDecorator(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").
+			ResponseSimple(200, "plain").
+			ResponseJSON(200, map[string]int{"count": 1}).
+			ResponseDNSError("example.com"),
+	)
+	mockTransport.SetResponseDecorator(func(req *http.Request, res *http.Response) *http.Response {
+		if res.Header == nil {
+			res.Header = http.Header{}
+		}
+		res.Header.Set("Server", "mock")
+		return res
+	})
+	client := http.Client{Transport: mockTransport}
+
+	for i := 0; i < 2; i++ {
+		res := lo.Must1(client.Get("http://example.com/sample"))
+		if e, g := "mock", res.Header.Get("Server"); e != g {
+			t.Errorf("unexpected Server header on response %d: expected %s, got %s", i, e, g)
+		}
+	}
+	if _, err := client.Get("http://example.com/sample"); err == nil {
+		t.Errorf("expected the error to pass through the decorator")
+	}
+}
+
+func TestMockTransportResponseEcho(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").Post("/echo").
+			ResponseEcho(201),
+	)
+	client := http.Client{Transport: mockTransport}
+
+	res := lo.Must1(client.Post("http://example.com/echo", "application/json", strings.NewReader(`{"name":"rtq"}`)))
+	got := []any{res.StatusCode, res.Header.Get("Content-Type"), string(lo.Must1(io.ReadAll(res.Body)))}
+	if diff := cmp.Diff([]any{201, "application/json", `{"name":"rtq"}`}, got); diff != "" {
+		t.Errorf("unexpected response: %s", diff)
+	}
+}
+
+func TestMockTransportQueryContains(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").QueryContains(map[string]string{"page": "2", "sort": ""}).
+			ResponseSimple(200, "ok").
+			ResponseSimple(200, "ok"),
+	)
+
+	for _, spec := range []struct {
+		URL   string
+		Match bool
+	}{
+		{URL: "http://example.com/sample?page=2", Match: false},
+		{URL: "http://example.com/sample?page=3&sort=", Match: false},
+		{URL: "http://example.com/sample?page=2&sort=&limit=10", Match: true},
+	} {
+		req := lo.Must1(http.NewRequest("GET", spec.URL, nil))
+		_, err := mockTransport.RoundTrip(req)
+		if e, g := spec.Match, err == nil; e != g {
+			t.Errorf("unexpected match for %s: expected %t, got %t", spec.URL, e, g)
+		}
+	}
+}
+
+func TestMockTransportBodyHash(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").BodyHash("sha256", "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824").
+			ResponseSimple(200, "sha256"),
+		New("http://example.com").BodyHash("md5", "5D41402ABC4B2A76B9719D911017C592").
+			ResponseSimple(200, "md5"),
+	)
+	client := http.Client{Transport: mockTransport}
+
+	if _, err := client.Post("http://example.com/upload", "application/octet-stream", strings.NewReader("hello!")); err == nil {
+		t.Errorf("expected a different body not to match")
+	}
+	for _, expect := range []string{"sha256", "md5"} {
+		res := lo.Must1(client.Post("http://example.com/upload", "application/octet-stream", strings.NewReader("hello")))
+		if e, g := expect, string(lo.Must1(io.ReadAll(res.Body))); e != g {
+			t.Errorf("unexpected body: expected %s, got %s", e, g)
+		}
+	}
+
+	req := lo.Must1(http.NewRequest("POST", "http://example.com/upload", strings.NewReader("hello")))
+	if _, err := NewTransport(New("http://example.com").BodyHash("crc32", "").ResponseSimple(200, "ok")).RoundTrip(req); err == nil {
+		t.Errorf("expected unsupported algorithm error")
+	}
+}
+
+// recordingTB captures errors reported through testing.TB instead of failing the test.
+type recordingTB struct {
+	testing.TB
+	errors []string
+}
+
+func (r *recordingTB) Helper() {}
+
+func (r *recordingTB) Errorf(format string, args ...any) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func TestMockTransportAssertRequestCount(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").
+			ResponseSimple(200, "ok"),
+	)
+	client := http.Client{Transport: mockTransport}
+
+	_, _ = client.Get("http://example.com/1")
+	_, _ = client.Get("http://example.com/2")
+	mockTransport.AssertRequestCount(t, 2)
+
+	rec := &recordingTB{TB: t}
+	mockTransport.AssertRequestCount(rec, 1)
+	expect := []string{"unexpected request count: expected 1, got 2\n" +
+		"1: GET http://example.com/1\n" +
+		"2: GET http://example.com/2 (not matched)"}
+	if diff := cmp.Diff(expect, rec.errors); diff != "" {
+		t.Errorf("unexpected errors: %s", diff)
+	}
+}
+
+func TestMockTransportWithRequest(t *testing.T) {
+	redirected := lo.Must1(http.NewRequest("GET", "http://example.com/final", nil))
+	base := New("http://example.com").
+		ResponseSimple(200, "ok")
+	mockTransport := NewTransport(
+		base.WithRequest(redirected),
+		base,
+	)
+	client := http.Client{Transport: mockTransport}
+
+	for _, expect := range []string{"/final", "/start"} {
+		res := lo.Must1(client.Get("http://example.com/start"))
+		if e, g := expect, res.Request.URL.Path; e != g {
+			t.Errorf("unexpected response request path: expected %s, got %s", e, g)
+		}
+	}
+
+	// Failed and empty round trips are passed through without setting the request
+	errBroken := errors.New("broken")
+	mockTransport = NewTransport(
+		New("http://example.com").
+			ResponseFunc(func(req *http.Request) (*http.Response, error) { return nil, errBroken }).WithRequest(redirected).
+			ResponseFunc(func(req *http.Request) (*http.Response, error) { return nil, nil }).WithRequest(redirected),
+	)
+	if _, err := mockTransport.RoundTrip(lo.Must1(http.NewRequest("GET", "http://example.com/start", nil))); !errors.Is(err, errBroken) {
+		t.Errorf("expected broken error, got %v", err)
+	}
+	if res, err := mockTransport.RoundTrip(lo.Must1(http.NewRequest("GET", "http://example.com/start", nil))); res != nil || err != nil {
+		t.Errorf("expected nil response and error, got %v, %v", res, err)
+	}
+}
+
+func TestMockTransportMatch(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").
+			Match(MatchSpec{
+				Method:  "GET",
+				Path:    "/x",
+				Headers: map[string]string{"Authorization": "Bearer test"},
+				Query:   map[string]string{"page": "2"},
+			}).
+			ResponseSimple(200, "ok").
+			ResponseSimple(200, "ok"),
+	)
+
+	for _, spec := range []struct {
+		Method string
+		URL    string
+		Auth   string
+		Match  bool
+	}{
+		{Method: "POST", URL: "http://example.com/x?page=2", Auth: "Bearer test", Match: false},
+		{Method: "GET", URL: "http://example.com/y?page=2", Auth: "Bearer test", Match: false},
+		{Method: "GET", URL: "http://example.com/x?page=2", Auth: "", Match: false},
+		{Method: "GET", URL: "http://example.com/x?page=1", Auth: "Bearer test", Match: false},
+		{Method: "GET", URL: "http://example.com/x?page=2", Auth: "Bearer test", Match: true},
+	} {
+		req := lo.Must1(http.NewRequest(spec.Method, spec.URL, nil))
+		req.Header.Set("Authorization", spec.Auth)
+		_, err := mockTransport.RoundTrip(req)
+		if e, g := spec.Match, err == nil; e != g {
+			t.Errorf("unexpected match for %s %s: expected %t, got %t", spec.Method, spec.URL, e, g)
+		}
+	}
+}
+
+func TestMockTransportResponseChannel(t *testing.T) {
+	ch := make(chan []byte)
+	mockTransport := NewTransport(
+		New("http://example.com").
+			ResponseChannel(200, ch),
+	)
+	client := http.Client{Transport: mockTransport}
+
+	res := lo.Must1(client.Get("http://example.com/stream"))
+	go func() {
+		ch <- []byte("hello, ")
+		ch <- []byte("world")
+		close(ch)
+	}()
+	if e, g := "hello, world", string(lo.Must1(io.ReadAll(res.Body))); e != g {
+		t.Errorf("unexpected body: expected %s, got %s", e, g)
+	}
+}
+
+func TestMockTransportRemainingFor(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").Get("/users").Name("users").
+			ResponseSimple(200, "1").
+			ResponseSimple(200, "2"),
+		New("http://example.com").Get("/posts").Name("posts").
+			ResponseSimple(200, "1"),
+	)
+	client := http.Client{Transport: mockTransport}
+
+	for _, expect := range []int{2, 1, 0} {
+		if g := mockTransport.RemainingFor("users"); expect != g {
+			t.Errorf("unexpected remaining: expected %d, got %d", expect, g)
+		}
+		_, _ = client.Get("http://example.com/users")
+	}
+	if e, g := 1, mockTransport.RemainingFor("posts"); e != g {
+		t.Errorf("unexpected remaining for posts: expected %d, got %d", e, g)
+	}
+	if e, g := 0, mockTransport.RemainingFor("unknown"); e != g {
+		t.Errorf("unexpected remaining for unknown: expected %d, got %d", e, g)
+	}
+}
+
+func TestMockTransportIsMultipart(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").IsMultipart().
+			ResponseSimple(200, "ok").
+			ResponseSimple(200, "ok"),
+	)
+	client := http.Client{Transport: mockTransport}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	lo.Must0(mw.WriteField("name", "rtq"))
+	lo.Must0(mw.Close())
+	if _, err := client.Post("http://example.com/upload", "application/json", strings.NewReader(`{}`)); err == nil {
+		t.Errorf("expected non-multipart request not to match")
+	}
+	if _, err := client.Post("http://example.com/upload", mw.FormDataContentType(), &body); err != nil {
+		t.Errorf("expected multipart request to match: %v", err)
+	}
+}
+
+func TestMockTransportServedResponses(t *testing.T) {
+	record := NewTransport(
+		New("http://example.com").Get("/users").Query("page", "2").
+			ResponseSimple(404, "not found"),
+		New("http://example.com").Get("/users").
+			ResponseJSON(200, []string{"alice"}),
+	)
+	client := http.Client{Transport: record}
+	record.EnableResponseCapture()
+	paths := []string{"/users?page=2", "/users"}
+	var expect []string
+	for _, path := range paths {
+		res := lo.Must1(client.Get("http://example.com" + path))
+		expect = append(expect, fmt.Sprintf("%d %s", res.StatusCode, lo.Must1(io.ReadAll(res.Body))))
+	}
+
+	served := record.ServedResponses()
+	if e, g := 2, len(served); e != g {
+		t.Fatalf("unexpected served count: expected %d, got %d", e, g)
+	}
+	if e, g := "application/json", served[1].Header.Get("Content-Type"); e != g {
+		t.Errorf("unexpected recorded Content-Type: expected %s, got %s", e, g)
+	}
+
+	// Replay in the reverse order to check that responses are matched by request rather than by position
+	replay := NewTransport(Replay(served)...)
+	client = http.Client{Transport: replay}
+	for i := len(paths) - 1; i >= 0; i-- {
+		res := lo.Must1(client.Get("http://example.com" + paths[i]))
+		if e, g := expect[i], fmt.Sprintf("%d %s", res.StatusCode, lo.Must1(io.ReadAll(res.Body))); e != g {
+			t.Errorf("unexpected replayed response for %s: expected %s, got %s", paths[i], e, g)
+		}
+	}
+	if !replay.Completed() {
+		t.Errorf("replay is not empty")
+	}
+
+	// Responses are not kept unless capture is enabled
+	uncaptured := NewTransport(Replay(served)...)
+	client = http.Client{Transport: uncaptured}
+	res := lo.Must1(client.Get("http://example.com/users"))
+	_ = lo.Must1(io.ReadAll(res.Body))
+	if served := uncaptured.ServedResponses(); len(served) != 0 {
+		t.Errorf("unexpected served responses without capture: %d", len(served))
+	}
+}
+
+func TestMockTransportAssertAllRequests(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").
+			ResponseSimple(200, "ok").
+			ResponseSimple(200, "ok"),
+	)
+	client := http.Client{Transport: mockTransport}
+
+	for _, trace := range []string{"1", "", "3"} {
+		req := lo.Must1(http.NewRequest("GET", "http://example.com/sample?trace="+trace, nil))
+		if trace != "" {
+			req.Header.Set("X-Trace-Id", trace)
+		}
+		_, _ = client.Do(req)
+	}
+	hasTrace := func(req *http.Request) bool { return req.Header.Get("X-Trace-Id") != "" }
+
+	rec := &recordingTB{TB: t}
+	mockTransport.AssertAllRequests(rec, hasTrace, "missing trace header")
+	expect := []string{"missing trace header: request 2 does not satisfy the predicate: GET http://example.com/sample?trace="}
+	if diff := cmp.Diff(expect, rec.errors); diff != "" {
+		t.Errorf("unexpected errors: %s", diff)
+	}
+
+	// The third request was not matched, so a predicate rejecting it does not fail
+	mockTransport.AssertAllRequests(t, func(req *http.Request) bool { return req.URL.Query().Get("trace") != "3" }, "unmatched request checked")
+}
+
+func TestMockTransportSucceedThenFail(t *testing.T) {
+	errOverloaded := errors.New("overloaded")
+	mockTransport := NewTransport(
+		New("http://example.com").
+			SucceedThenFail(2, &http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader("ok"))}, errOverloaded),
+	)
+	client := http.Client{Transport: mockTransport}
+
+	for i, expectErr := range []bool{false, false, true, true} {
+		res, err := client.Get("http://example.com/sample")
+		if expectErr {
+			if !errors.Is(err, errOverloaded) {
+				t.Errorf("call %d: expected overloaded error, got %v", i+1, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("call %d: %v", i+1, err)
+		}
+		if e, g := "ok", string(lo.Must1(io.ReadAll(res.Body))); e != g {
+			t.Errorf("call %d: unexpected body: expected %s, got %s", i+1, e, g)
+		}
+	}
+}
+
+func TestMockTransportSignatureMatch(t *testing.T) {
+	secret := []byte("secret")
+	sign := func(req *http.Request) (string, error) {
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			return "", err
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(body)
+		return hex.EncodeToString(mac.Sum(nil)), nil
+	}
+	mockTransport := NewTransport(
+		New("http://example.com").SignatureMatch("X-Signature", sign).BodyString(`{"id":1}`).
+			ResponseSimple(200, "ok").
+			ResponseSimple(200, "ok"),
+	)
+	client := http.Client{Transport: mockTransport}
+
+	for _, spec := range []struct {
+		Signature string
+		Match     bool
+	}{
+		{Signature: "invalid", Match: false},
+		{Signature: lo.Must1(sign(lo.Must1(http.NewRequest("POST", "http://example.com", strings.NewReader(`{"id":1}`))))), Match: true},
+	} {
+		req := lo.Must1(http.NewRequest("POST", "http://example.com/hook", strings.NewReader(`{"id":1}`)))
+		req.Header.Set("X-Signature", spec.Signature)
+		_, err := client.Do(req)
+		if e, g := spec.Match, err == nil; e != g {
+			t.Errorf("unexpected match for %s: expected %t, got %t", spec.Signature, e, g)
+		}
+	}
+}
+
+func TestMockTransportUnmatchedChan(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").Get("/known").
+			ResponseSimple(200, "ok"),
+	)
+	client := http.Client{Transport: mockTransport}
+	unmatched := mockTransport.UnmatchedChan()
+
+	for _, path := range []string{"/unknown/1", "/known", "/unknown/2"} {
+		_, _ = client.Get("http://example.com" + path)
+	}
+	mockTransport.Close()
+
+	var got []string
+	for req := range unmatched {
+		got = append(got, req.URL.Path)
+	}
+	if diff := cmp.Diff([]string{"/unknown/1", "/unknown/2"}, got); diff != "" {
+		t.Errorf("unexpected unmatched requests: %s", diff)
+	}
+}
+
+func TestMockTransportResponseHeaderDelay(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").
+			ResponseHeaderDelay(20*time.Millisecond, 200, "ok").
+			ResponseHeaderDelay(time.Second, 200, "too late"),
+	)
+	client := http.Client{Transport: mockTransport}
+
+	start := time.Now()
+	res := lo.Must1(client.Get("http://example.com/sample"))
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("header delay not applied: elapsed %s", elapsed)
+	}
+	if e, g := "ok", string(lo.Must1(io.ReadAll(res.Body))); e != g {
+		t.Errorf("unexpected body: expected %s, got %s", e, g)
+	}
+
+	client.Timeout = 5 * time.Millisecond
+	if _, err := client.Get("http://example.com/sample"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestMockTransportJSONRPC(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").Post("/rpc").JSONRPCMethod("add").
+			ResponseJSONRPCResult(3),
+		New("http://example.com").Post("/rpc").JSONRPCMethod("divide").
+			ResponseJSONRPCError(-32602, "division by zero"),
+	)
+	client := http.Client{Transport: mockTransport}
+
+	for _, spec := range []struct {
+		Request string
+		Expect  string
+	}{
+		{
+			Request: `{"jsonrpc":"2.0","method":"divide","params":[1,0],"id":"b"}`,
+			Expect:  `{"jsonrpc":"2.0","error":{"code":-32602,"message":"division by zero"},"id":"b"}`,
+		},
+		{
+			Request: `{"jsonrpc":"2.0","method":"add","params":[1,2],"id":1}`,
+			Expect:  `{"jsonrpc":"2.0","result":3,"id":1}`,
+		},
+	} {
+		res := lo.Must1(client.Post("http://example.com/rpc", "application/json", strings.NewReader(spec.Request)))
+		if diff := cmp.Diff(spec.Expect, string(lo.Must1(io.ReadAll(res.Body)))); diff != "" {
+			t.Errorf("unexpected response for %s: %s", spec.Request, diff)
+		}
+	}
+	if !mockTransport.Completed() {
+		t.Errorf("mockTransport is not empty")
+	}
+}
+
+func TestMockTransportRoute(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").Route("GET", "/users/{id}/posts/{post}").
+			ResponseFunc(func(req *http.Request) (*http.Response, error) {
+				body := PathParam(req, "id") + ":" + PathParam(req, "post")
+				return &http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader(body)), Request: req}, nil
+			}),
+	)
+	client := http.Client{Transport: mockTransport}
+
+	for _, path := range []string{"/users/42/posts", "/users//posts/7", "/users/42/comments/7"} {
+		if _, err := client.Get("http://example.com" + path); err == nil {
+			t.Errorf("expected %s not to match", path)
+		}
+	}
+	res := lo.Must1(client.Get("http://example.com/users/42/posts/7"))
+	if e, g := "42:7", string(lo.Must1(io.ReadAll(res.Body))); e != g {
+		t.Errorf("unexpected body: expected %s, got %s", e, g)
+	}
+}
+
+func TestMockTransportParallelQueueTags(t *testing.T) {
+	const n = 50
+	users := New("http://example.com").Get("/users").Name("users")
+	posts := New("http://example.com").Get("/posts").Name("posts")
+	for i := 0; i < n; i++ {
+		users = users.ResponseSimple(200, "users")
+		posts = posts.ResponseSimple(200, "posts")
+	}
+	mockTransport := NewTransport(users, posts)
+	client := http.Client{Transport: mockTransport}
+
+	bodies := lop.Times(2*n, func(i int) string {
+		path := []string{"/users", "/posts"}[i%2]
+		res, err := client.Get("http://example.com" + path)
+		if err != nil {
+			t.Error(err)
+			return ""
+		}
+		return path + " " + string(lo.Must1(io.ReadAll(res.Body)))
+	})
+	for _, body := range bodies {
+		if path, tag, _ := strings.Cut(body, " "); path != "/"+tag {
+			t.Errorf("response %q served by the wrong queue", body)
+		}
+	}
+
+	counts := map[string]int{}
+	for _, e := range mockTransport.RequestLogEntries() {
+		if e.Request.URL.Path != "/"+e.QueueName {
+			t.Errorf("request %s tagged with queue %q", e.Request.URL.Path, e.QueueName)
+		}
+		counts[e.QueueName]++
+	}
+	if diff := cmp.Diff(map[string]int{"users": n, "posts": n}, counts); diff != "" {
+		t.Errorf("unexpected distribution: %s", diff)
+	}
+	if !mockTransport.Completed() {
+		t.Error("mockTransport is not empty")
+	}
+}
+
+func TestMockTransportRequireHTTPS(t *testing.T) {
+	mockTransport := NewTransport(
+		New("https://example.com").RequireHTTPS().
+			ResponseSimple(200, "ok"),
+	)
+	client := http.Client{Transport: mockTransport}
+
+	if _, err := client.Get("http://example.com/login"); err == nil {
+		t.Errorf("expected http request not to match")
+	}
+	if _, err := client.Get("https://example.com/login"); err != nil {
+		t.Errorf("expected https request to match: %v", err)
+	}
+}
+
+func TestMockTransportResponseByLanguage(t *testing.T) {
+	cases := map[string]string{"en": "hello", "ja": "こんにちは", "fr-CA": "bonjour"}
+	q := New("http://example.com")
+	specs := []struct {
+		AcceptLanguage string
+		Body           string
+	}{
+		{AcceptLanguage: "ja", Body: "こんにちは"},
+		{AcceptLanguage: "fr-ca", Body: "bonjour"},
+		{AcceptLanguage: "en-US,en;q=0.9", Body: "hello"},
+		{AcceptLanguage: "de;q=1.0, ja;q=0.5, en;q=0.8", Body: "hello"},
+		{AcceptLanguage: "ja;q=0, de", Body: "default"},
+		{AcceptLanguage: "", Body: "default"},
+	}
+	for range specs {
+		q = q.ResponseByLanguage(200, cases, "default")
+	}
+	client := http.Client{Transport: NewTransport(q)}
+
+	for _, spec := range specs {
+		req := lo.Must1(http.NewRequest("GET", "http://example.com/greeting", nil))
+		req.Header.Set("Accept-Language", spec.AcceptLanguage)
+		res := lo.Must1(client.Do(req))
+		if e, g := spec.Body, string(lo.Must1(io.ReadAll(res.Body))); e != g {
+			t.Errorf("unexpected body for %q: expected %s, got %s", spec.AcceptLanguage, e, g)
+		}
+	}
+}
+
+func TestMockTransportNormalizeResponseBodies(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").
+			ResponseSimple(200, "{\n  \"id\": 1\n}\n  \n").
+			ResponseJSON(200, map[string]int{"id": 1}),
+	)
+	mockTransport.NormalizeResponseBodies()
+	client := http.Client{Transport: mockTransport}
+
+	res := lo.Must1(client.Get("http://example.com/sample"))
+	if e, g := "{\n  \"id\": 1\n}", string(lo.Must1(io.ReadAll(res.Body))); e != g {
+		t.Errorf("unexpected body: expected %q, got %q", e, g)
+	}
+
+	mockTransport.SetBodyNormalizer(strings.ToUpper)
+	res = lo.Must1(client.Get("http://example.com/sample"))
+	if e, g := `{"id":1}`, string(lo.Must1(io.ReadAll(res.Body))); e != g {
+		t.Errorf("expected JSON response not to be normalized: expected %q, got %q", e, g)
+	}
+}
+
+func TestMockTransportIsProxyRequest(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").IsProxyRequest().
+			ResponseSimple(200, "ok"),
+	)
+
+	for _, spec := range []struct {
+		Raw   string
+		Match bool
+	}{
+		{Raw: "GET /sample HTTP/1.1\r\nHost: example.com\r\n\r\n", Match: false},
+		{Raw: "GET http://example.com/sample HTTP/1.1\r\nHost: example.com\r\n\r\n", Match: true},
+	} {
+		req := lo.Must1(http.ReadRequest(bufio.NewReader(strings.NewReader(spec.Raw))))
+		// Origin-form requests carry only the path in URL, so complete it for the origin matcher
+		req.URL.Scheme, req.URL.Host = "http", req.Host
+		_, err := mockTransport.RoundTrip(req)
+		if e, g := spec.Match, err == nil; e != g {
+			t.Errorf("unexpected match for %s: expected %t, got %t", req.RequestURI, e, g)
+		}
+	}
+}
+
+func TestMockTransportExpectCalls(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").Get("/ring").ExpectCalls(2).
+			ResponseRing(&http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader("ok"))}),
+		New("http://example.com").Get("/once").ExpectCalls(1).
+			ResponseSimple(200, "ok"),
+	)
+	client := http.Client{Transport: mockTransport}
+
+	for _, path := range []string{"/ring", "/once", "/ring"} {
+		_, _ = client.Get("http://example.com" + path)
+	}
+	mockTransport.AssertCompleted(t)
+
+	_, _ = client.Get("http://example.com/ring")
+	rec := &recordingTB{TB: t}
+	mockTransport.AssertCompleted(rec)
+	expect := []string{"unexpected call count for queue 0: expected 2, got 3"}
+	if diff := cmp.Diff(expect, rec.errors); diff != "" {
+		t.Errorf("unexpected errors: %s", diff)
+	}
+}
+
+func TestMockTransportFallback(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").
+			ResponseSimple(202, "pending").
+			ResponseSimple(202, "pending").
+			Fallback(&http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader("done"))}),
+	)
+	client := http.Client{Transport: mockTransport}
+
+	for i, expect := range []string{"pending", "pending", "done", "done", "done"} {
+		res := lo.Must1(client.Get("http://example.com/job"))
+		if g := string(lo.Must1(io.ReadAll(res.Body))); expect != g {
+			t.Errorf("call %d: unexpected body: expected %s, got %s", i+1, expect, g)
+		}
+	}
+	if !mockTransport.Completed() {
+		t.Errorf("mockTransport is not empty")
+	}
+}
+
+func TestMockTransportContentMD5Valid(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").ContentMD5Valid().
+			ResponseSimple(200, "ok"),
+	)
+	client := http.Client{Transport: mockTransport}
+
+	for _, spec := range []struct {
+		Checksum string
+		Match    bool
+	}{
+		{Checksum: "", Match: false},
+		{Checksum: "AAAAAAAAAAAAAAAAAAAAAA==", Match: false},
+		{Checksum: "XUFAKrxLKna5cZ2REBfFkg==", Match: true},
+	} {
+		req := lo.Must1(http.NewRequest("PUT", "http://example.com/object", strings.NewReader("hello")))
+		req.Header.Set("Content-MD5", spec.Checksum)
+		_, err := client.Do(req)
+		if e, g := spec.Match, err == nil; e != g {
+			t.Errorf("unexpected match for %q: expected %t, got %t", spec.Checksum, e, g)
+		}
+	}
+}
+
+func TestMockTransportSetVerbose(t *testing.T) {
+	isJSON := func(req *http.Request) (bool, error) {
+		return req.Header.Get("Content-Type") == "application/json", nil
+	}
+	mockTransport := NewTransport(
+		New("http://example.com").Header("Authorization", "Bearer test").
+			ResponseSimple(200, "auth"),
+		New("http://example.com").Get("/users").
+			ResponseSimple(200, "users"),
+		New("http://example.com").Post("/users").Matcher(isJSON).
+			ResponseSimple(201, "created"),
+	)
+	var log bytes.Buffer
+	mockTransport.SetVerbose(&log)
+	client := http.Client{Transport: mockTransport}
+
+	_, _ = client.Get("http://example.com/users")
+	_, _ = client.Post("http://example.com/users", "text/plain", nil)
+	expect := `GET http://example.com/users
+  queue 0: New=true Header=false
+  queue 1: New=true method=true path=true
+  => queue 1
+POST http://example.com/users
+  queue 0: New=true Header=false
+  queue 1: nothing to serve
+  queue 2: New=true method=true path=true TestMockTransportSetVerbose=false
+  => not matched
+`
+	if diff := cmp.Diff(expect, log.String()); diff != "" {
+		t.Errorf("unexpected verbose log: %s", diff)
+	}
+}
+
+func TestMockTransportResponseSetCookies(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").
+			ResponseSetCookies(200, &http.Cookie{Name: "session", Value: "abc"}, &http.Cookie{Name: "theme", Value: "dark"}),
+	)
+	jar := lo.Must1(cookiejar.New(nil))
+	client := http.Client{Transport: mockTransport, Jar: jar}
+
+	res := lo.Must1(client.Get("http://example.com/login"))
+	if e, g := 2, len(res.Header.Values("Set-Cookie")); e != g {
+		t.Errorf("unexpected Set-Cookie count: expected %d, got %d", e, g)
+	}
+	got := lo.Map(jar.Cookies(lo.Must1(url.Parse("http://example.com/"))), func(c *http.Cookie, _ int) string { return c.String() })
+	if diff := cmp.Diff([]string{"session=abc", "theme=dark"}, got); diff != "" {
+		t.Errorf("unexpected cookies in jar: %s", diff)
+	}
+}
+
+func TestMockTransportBodyValidUTF8(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").BodyValidUTF8().
+			ResponseSimple(200, "ok").
+			ResponseSimple(200, "ok"),
+	)
+	client := http.Client{Transport: mockTransport}
+
+	for _, spec := range []struct {
+		Body  []byte
+		Match bool
+	}{
+		{Body: []byte{0xe3, 0x81}, Match: false},
+		{Body: []byte("na\xefve"), Match: false},
+		{Body: []byte("こんにちは"), Match: true},
+		{Body: []byte("naïve"), Match: true},
+	} {
+		_, err := client.Post("http://example.com/text", "text/plain", bytes.NewReader(spec.Body))
+		if e, g := spec.Match, err == nil; e != g {
+			t.Errorf("unexpected match for %x: expected %t, got %t", spec.Body, e, g)
+		}
+	}
+}
+
+func TestMockTransportPathRegexp(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").Method(http.MethodGet).PathRegexp(`^/v2/users/\d+/posts/\d+$`).
+			ResponseSimple(200, "ok").
+			ResponseSimple(200, "ok"),
+	)
+
+	for _, spec := range []struct {
+		Method string
+		Path   string
+		Match  bool
+	}{
+		{Method: "GET", Path: "/v2/users/abc/posts/456", Match: false},
+		{Method: "POST", Path: "/v2/users/123/posts/456", Match: false},
+		{Method: "GET", Path: "/v2/users/123/posts/456", Match: true},
+	} {
+		req := lo.Must1(http.NewRequest(spec.Method, "http://example.com"+spec.Path, nil))
+		_, err := mockTransport.RoundTrip(req)
+		if e, g := spec.Match, err == nil; e != g {
+			t.Errorf("unexpected match for %s %s: expected %t, got %t", spec.Method, spec.Path, e, g)
+		}
+	}
+
+	req := lo.Must1(http.NewRequest("GET", "http://example.com/v2/users", nil))
+	if _, err := NewTransport(New("http://example.com").PathRegexp("[").ResponseSimple(200, "ok")).RoundTrip(req); err == nil {
+		t.Errorf("expected invalid pattern error")
+	}
+}
+
+func TestMockTransportResponseDelayFunc(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").
+			ResponseDelayFunc(func(req *http.Request) time.Duration {
+				if req.URL.Query().Get("id") == "1" {
+					return 50 * time.Millisecond
+				}
+				return 0
+			}).
+			ResponseEcho(200).
+			ResponseEcho(200),
+	)
+	client := http.Client{Transport: mockTransport}
+
+	var (
+		mu        sync.Mutex
+		completed []string
+		wg        sync.WaitGroup
+	)
+	for _, id := range []string{"1", "2"} {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			res, err := client.Post("http://example.com/echo?id="+id, "text/plain", strings.NewReader(id))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if body := string(lo.Must1(io.ReadAll(res.Body))); body != id {
+				t.Errorf("response for request %s has body %s", id, body)
+			}
+			mu.Lock()
+			completed = append(completed, id)
+			mu.Unlock()
+		}(id)
+		// Make sure request 1 is served first so that only the delay can reorder completion
+		time.Sleep(10 * time.Millisecond)
+	}
+	wg.Wait()
+
+	if diff := cmp.Diff([]string{"2", "1"}, completed); diff != "" {
+		t.Errorf("unexpected completion order: %s", diff)
+	}
+}
+
+func TestMockTransportMatchCurl(t *testing.T) {
+	curl := `curl -X PUT 'http://example.com/users/1?notify=true' \
+  -H 'Content-Type: application/json' \
+  -H "Authorization: Bearer test" \
+  --data-raw '{"name":"rtq"}'`
+	mockTransport := NewTransport(
+		New("http://example.com").MatchCurl(curl).
+			ResponseSimple(200, "ok").
+			ResponseSimple(200, "ok"),
+	)
+	client := http.Client{Transport: mockTransport}
+
+	newRequest := func(method, url, body string) *http.Request {
+		req := lo.Must1(http.NewRequest(method, url, strings.NewReader(body)))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer test")
+		return req
+	}
+	for _, spec := range []struct {
+		Request *http.Request
+		Match   bool
+	}{
+		{Request: newRequest("POST", "http://example.com/users/1?notify=true", `{"name":"rtq"}`), Match: false},
+		{Request: newRequest("PUT", "http://example.com/users/1", `{"name":"rtq"}`), Match: false},
+		{Request: newRequest("PUT", "http://example.com/users/1?notify=true", `{"name":"go"}`), Match: false},
+		{Request: newRequest("PUT", "http://example.com/users/1?notify=true", `{"name":"rtq"}`), Match: true},
+	} {
+		_, err := client.Do(spec.Request)
+		if e, g := spec.Match, err == nil; e != g {
+			t.Errorf("unexpected match for %s %s: expected %t, got %t", spec.Request.Method, spec.Request.URL, e, g)
+		}
+	}
+
+	for _, spec := range []struct {
+		Curl string
+		Err  string
+	}{
+		{Curl: "curl -s -L -i -k http://example.com/users --compressed", Err: ""},
+		{Curl: "curl example.com/users", Err: ""},
+		{Curl: "curl -F name=rtq http://example.com/users", Err: "curl: unsupported flag -F"},
+		{Curl: "curl http://example.com/users -H", Err: "curl: missing value for -H"},
+	} {
+		req := lo.Must1(http.NewRequest("GET", "http://example.com/users", nil))
+		_, err := NewTransport(New("http://example.com").MatchCurl(spec.Curl).ResponseSimple(200, "ok")).RoundTrip(req)
+		if spec.Err == "" {
+			if err != nil {
+				t.Errorf("unexpected error for %q: %v", spec.Curl, err)
+			}
+			continue
+		}
+		if diff := cmp.Diff(spec.Err, fmt.Sprint(err)); diff != "" {
+			t.Errorf("unexpected error for %q: %s", spec.Curl, diff)
+		}
+	}
+}
+
+func TestMockTransportPathTemplate(t *testing.T) {
+	echoParams := func(req *http.Request) (*http.Response, error) {
+		body := PathParam(req, "id") + ":" + PathParam(req, "postID")
+		return &http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader(body)), Request: req}, nil
+	}
+	mockTransport := NewTransport(
+		New("http://example.com").PathTemplate("/users/:id/posts/:postID").
+			ResponseFunc(echoParams).
+			ResponseFunc(echoParams),
+		New("http://example.com").PathTemplate("/users/:id/").
+			ResponseFunc(echoParams),
+	)
+	client := http.Client{Transport: mockTransport}
+
+	for _, spec := range []struct {
+		Path string
+		Body string
+	}{
+		{Path: "/users/7/posts/99/comments", Body: ""},
+		{Path: "/users/7/posts/99/", Body: ""},
+		{Path: "/users/7/comments/99", Body: ""},
+		{Path: "/users/7", Body: ""},
+		{Path: "/users/7/posts/99", Body: "7:99"},
+		{Path: "/users/8/", Body: "8:"},
+	} {
+		res, err := client.Get("http://example.com" + spec.Path)
+		if spec.Body == "" {
+			if err == nil {
+				t.Errorf("expected %s not to match", spec.Path)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e, g := spec.Body, string(lo.Must1(io.ReadAll(res.Body))); e != g {
+			t.Errorf("unexpected body for %s: expected %s, got %s", spec.Path, e, g)
+		}
+	}
+
+	for _, build := range []func() RoundTripQueue{
+		func() RoundTripQueue {
+			return New("http://example.com").Route("GET", "/users/{id}").PathTemplate("/posts/:id")
+		},
+		func() RoundTripQueue {
+			return New("http://example.com").PathTemplate("/users/:id").PathTemplate("/posts/:id")
+		},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected a second route to panic")
+				}
+			}()
+			build()
+		}()
+	}
+}
+
+func TestMockTransportResponseFactory(t *testing.T) {
+	calls := 0
+	factory := func() *http.Response {
+		calls++
+		return &http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader(fmt.Sprintf("call %d", calls)))}
+	}
+	mockTransport := NewTransport(
+		New("http://example.com").
+			ResponseFactory(factory).
+			ResponseFactory(factory),
+	)
+	client := http.Client{Transport: mockTransport}
+
+	for _, expect := range []string{"call 1", "call 2"} {
+		res := lo.Must1(client.Get("http://example.com/sample"))
+		if g := string(lo.Must1(io.ReadAll(res.Body))); expect != g {
+			t.Errorf("unexpected body: expected %s, got %s", expect, g)
+		}
+		if res.Request == nil {
+			t.Errorf("expected response to carry the request")
+		}
+	}
+	if !mockTransport.Completed() {
+		t.Errorf("mockTransport is not empty")
+	}
+}
+
+func TestMockTransportBodyJSON(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").BodyJSON(map[string]any{"a": 1, "b": []int{2, 3}}).
+			ResponseEcho(200).
+			ResponseEcho(200),
+	)
+	client := http.Client{Transport: mockTransport}
+
+	for _, spec := range []struct {
+		Body  string
+		Match bool
+	}{
+		{Body: `{"a":1,"b":[3,2]}`, Match: false},
+		{Body: `{"a":1,"b":[2,3],"c":null}`, Match: false},
+		{Body: `{ "b": [2, 3], "a": 1 }`, Match: true},
+		{Body: `{"a":1.0,"b":[2e0,3]}`, Match: true},
+	} {
+		res, err := client.Post("http://example.com/sample", "application/json", strings.NewReader(spec.Body))
+		if e, g := spec.Match, err == nil; e != g {
+			t.Errorf("unexpected match for %s: expected %t, got %t", spec.Body, e, g)
+			continue
+		}
+		// The body is restored for the response func
+		if err == nil {
+			if e, g := spec.Body, string(lo.Must1(io.ReadAll(res.Body))); e != g {
+				t.Errorf("unexpected echoed body: expected %s, got %s", e, g)
+			}
+		}
+	}
+
+	req := lo.Must1(http.NewRequest("POST", "http://example.com/sample", strings.NewReader(`{"a":`)))
+	_, err := NewTransport(New("http://example.com").BodyJSON(map[string]any{}).ResponseSimple(200, "ok")).RoundTrip(req)
+	if err == nil || !strings.Contains(err.Error(), "invalid JSON request body") {
+		t.Errorf("expected invalid JSON error, got %v", err)
+	}
+}
+
+func TestMockTransportJWTClaim(t *testing.T) {
+	token := func(payload string) string {
+		enc := base64.RawURLEncoding
+		return "Bearer " + enc.EncodeToString([]byte(`{"alg":"none"}`)) + "." + enc.EncodeToString([]byte(payload)) + ".sig"
+	}
+	mockTransport := NewTransport(
+		New("http://example.com").JWTClaim("sub", "user-1").
+			ResponseSimple(200, "ok").
+			ResponseSimple(200, "ok"),
+	)
+
+	for _, spec := range []struct {
+		Authorization string
+		Match         bool
+	}{
+		{Authorization: token(`{"sub":"user-2"}`), Match: false},
+		{Authorization: token(`{"scope":"read"}`), Match: false},
+		{Authorization: "Bearer not-a-jwt", Match: false},
+		{Authorization: "Bearer a.!!!.c", Match: false},
+		{Authorization: token(`{"sub":"user-1","scope":"read"}`), Match: true},
+	} {
+		req := lo.Must1(http.NewRequest("GET", "http://example.com/me", nil))
+		req.Header.Set("Authorization", spec.Authorization)
+		_, err := mockTransport.RoundTrip(req)
+		if e, g := spec.Match, err == nil; e != g {
+			t.Errorf("unexpected match for %s: expected %t, got %t", spec.Authorization, e, g)
+		}
+	}
+}
+
+func TestMockTransportBodyJSONContains(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").BodyJSONContains(map[string]any{
+			"userId": 5,
+			"meta":   map[string]any{"source": "web"},
+			"items":  []any{map[string]any{"id": 1}},
+		}).
+			ResponseSimple(200, "ok").
+			ResponseSimple(200, "ok"),
+	)
+	client := http.Client{Transport: mockTransport}
+
+	for _, spec := range []struct {
+		Body  string
+		Match bool
+	}{
+		{Body: `{"userId":6,"meta":{"source":"web"},"items":[{"id":1}]}`, Match: false},
+		{Body: `{"userId":5,"meta":{"source":"app"},"items":[{"id":1}]}`, Match: false},
+		{Body: `{"userId":5,"meta":{"source":"web"},"items":[{"id":2},{"id":1}]}`, Match: false},
+		{Body: `{"userId":5,"meta":{"source":"web"},"items":[]}`, Match: false},
+		{Body: `{"userId":5,"name":"rtq","meta":{"source":"web","ip":"::1"},"items":[{"id":1,"qty":2},{"id":3}]}`, Match: true},
+	} {
+		_, err := client.Post("http://example.com/orders", "application/json", strings.NewReader(spec.Body))
+		if e, g := spec.Match, err == nil; e != g {
+			t.Errorf("unexpected match for %s: expected %t, got %t", spec.Body, e, g)
+		}
+	}
+}
+
+func TestMockTransportTimes(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").Get("/ping").
+			ResponseSimple(200, "ok").Times(5),
+	)
+	client := http.Client{Transport: mockTransport}
+
+	for i := 0; i < 5; i++ {
+		if mockTransport.Completed() {
+			t.Errorf("mockTransport completed after %d calls", i)
+		}
+		res, err := client.Get("http://example.com/ping")
+		if err != nil {
+			t.Fatalf("call %d: %v", i+1, err)
+		}
+		if e, g := "ok", string(lo.Must1(io.ReadAll(res.Body))); e != g {
+			t.Errorf("call %d: unexpected body: expected %s, got %s", i+1, e, g)
+		}
+	}
+	if !mockTransport.Completed() {
+		t.Errorf("mockTransport is not empty")
+	}
+	if _, err := client.Get("http://example.com/ping"); err == nil {
+		t.Errorf("expected sixth call not to match")
+	}
+}
+
+func TestMockTransportAssertServedBody(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").Get("/users").
+			ResponseSimple(200, "users"),
+		New("http://example.com").Get("/posts").
+			ResponseSimple(200, "posts"),
+	)
+	client := http.Client{Transport: mockTransport}
+	mockTransport.EnableResponseCapture()
+
+	for _, path := range []string{"/posts", "/users"} {
+		res := lo.Must1(client.Get("http://example.com" + path))
+		_ = lo.Must1(io.ReadAll(res.Body))
+	}
+	mockTransport.AssertServedBody(t, 0, "posts")
+	mockTransport.AssertServedBody(t, 1, "users")
+
+	rec := &recordingTB{TB: t}
+	mockTransport.AssertServedBody(rec, 0, "users")
+	mockTransport.AssertServedBody(rec, 2, "")
+	expect := []string{
+		`unexpected body of served response 0: expected "users", got "posts"`,
+		"no served response at index 2: 2 served",
+	}
+	if diff := cmp.Diff(expect, rec.errors); diff != "" {
+		t.Errorf("unexpected errors: %s", diff)
+	}
+}
+
+func TestMockTransportSetMaxRequests(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").
+			ResponseRing(&http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader("ok"))}),
+	)
+	mockTransport.SetMaxRequests(3)
+	client := http.Client{Transport: mockTransport}
+
+	for i := 0; i < 3; i++ {
+		if _, err := client.Get("http://example.com/retry"); err != nil {
+			t.Fatalf("call %d: %v", i+1, err)
+		}
+	}
+	_, err := client.Get("http://example.com/retry")
+	if diff := cmp.Diff(`Get "http://example.com/retry": exceeded max requests (3)`, fmt.Sprint(err)); diff != "" {
+		t.Errorf("unexpected error: %s", diff)
+	}
+	if e, g := 3, len(mockTransport.RequestLogEntries()); e != g {
+		t.Errorf("unexpected logged requests: expected %d, got %d", e, g)
+	}
+}
+
+func TestMockTransportAlwaysResponseSimple(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").Get("/health").
+			AlwaysResponseSimple(200, "healthy"),
+		New("http://example.com").Get("/users").
+			ResponseSimple(200, "users"),
+	)
+	client := http.Client{Transport: mockTransport}
+
+	if mockTransport.Completed() {
+		t.Errorf("mockTransport completed with queued responses left")
+	}
+	for i := 0; i < 3; i++ {
+		res := lo.Must1(client.Get("http://example.com/health"))
+		if e, g := "healthy", string(lo.Must1(io.ReadAll(res.Body))); e != g {
+			t.Errorf("call %d: unexpected body: expected %s, got %s", i+1, e, g)
+		}
+	}
+	_, _ = client.Get("http://example.com/users")
+	// Only the persistent response remains, which does not block completion
+	if !mockTransport.Completed() {
+		t.Errorf("mockTransport is not empty")
+	}
+	if _, err := client.Get("http://example.com/health"); err != nil {
+		t.Errorf("expected persistent response after completion: %v", err)
+	}
+}
+
+func TestMockTransportDelay(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").
+			ResponseSimple(200, "slow").Delay(time.Second).
+			ResponseSimple(200, "fast").Delay(10 * time.Millisecond),
+	)
+	client := http.Client{Transport: mockTransport, Timeout: 50 * time.Millisecond}
+
+	if _, err := client.Get("http://example.com/sample"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+	res, err := client.Get("http://example.com/sample")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := "fast", string(lo.Must1(io.ReadAll(res.Body))); e != g {
+		t.Errorf("unexpected body: expected %s, got %s", e, g)
+	}
+}
+
+func TestMockTransportHasRange(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").HasRange().
+			ResponseSimple(206, "partial"),
+		New("http://example.com").NoRange().
+			ResponseSimple(200, "full"),
+	)
+	client := http.Client{Transport: mockTransport}
+
+	for _, spec := range []struct {
+		Range  string
+		Status int
+	}{
+		{Range: "", Status: 200},
+		{Range: "bytes=0-99", Status: 206},
+	} {
+		req := lo.Must1(http.NewRequest("GET", "http://example.com/file", nil))
+		if spec.Range != "" {
+			req.Header.Set("Range", spec.Range)
+		}
+		res := lo.Must1(client.Do(req))
+		if e, g := spec.Status, res.StatusCode; e != g {
+			t.Errorf("unexpected status for Range %q: expected %d, got %d", spec.Range, e, g)
+		}
+	}
+}
+
+func TestMockTransportResponseError(t *testing.T) {
+	errCustom := errors.New("connection reset")
+	mockTransport := NewTransport(
+		New("http://example.com").
+			ResponseError(io.ErrUnexpectedEOF).
+			ResponseError(errCustom).
+			ResponseSimple(200, "ok"),
+	)
+	client := http.Client{Transport: mockTransport}
+
+	for _, expect := range []error{io.ErrUnexpectedEOF, errCustom} {
+		_, err := client.Get("http://example.com/sample")
+		var urlErr *url.Error
+		if !errors.As(err, &urlErr) {
+			t.Fatalf("expected *url.Error, got %T", err)
+		}
+		if !errors.Is(err, expect) {
+			t.Errorf("unexpected error: expected %v, got %v", expect, err)
+		}
+	}
+	if _, err := client.Get("http://example.com/sample"); err != nil {
+		t.Errorf("expected retry to succeed: %v", err)
+	}
+}
+
+func TestMockTransportPathInsensitive(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").PathInsensitive("/Users/Me").
+			ResponseSimple(200, "ok").
+			ResponseSimple(200, "ok"),
+	)
+
+	for _, spec := range []struct {
+		Path  string
+		Match bool
+	}{
+		{Path: "/users/you", Match: false},
+		{Path: "/users/me", Match: true},
+		{Path: "/USERS/ME", Match: true},
+	} {
+		req := lo.Must1(http.NewRequest("GET", "http://example.com"+spec.Path, nil))
+		_, err := mockTransport.RoundTrip(req)
+		if e, g := spec.Match, err == nil; e != g {
+			t.Errorf("unexpected match for %s: expected %t, got %t", spec.Path, e, g)
+		}
+	}
+}
+
+func TestMockTransportUnmatchedRequests(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").Get("/known").
+			ResponseSimple(200, "ok"),
+	)
+	client := http.Client{Transport: mockTransport}
+
+	_, _ = client.Get("http://example.com/known")
+	req := lo.Must1(http.NewRequest("DELETE", "http://example.com/unknown", nil))
+	req.Header.Set("X-Request-Id", "42")
+	_, _ = client.Do(req)
+
+	got := lo.Map(mockTransport.UnmatchedRequests(), func(r *http.Request, _ int) string {
+		return fmt.Sprintf("%s %s %s", r.Method, r.URL, r.Header.Get("X-Request-Id"))
+	})
+	if diff := cmp.Diff([]string{"DELETE http://example.com/unknown 42"}, got); diff != "" {
+		t.Errorf("unexpected unmatched requests: %s", diff)
+	}
+}
+
+func TestMockTransportResponseAlternateBody(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").
+			ResponseAlternateBody(200, "full", ""),
+	)
+	client := http.Client{Transport: mockTransport}
+
+	for i, expect := range []string{"full", "", "full", ""} {
+		res := lo.Must1(client.Get("http://example.com/flaky"))
+		if g := string(lo.Must1(io.ReadAll(res.Body))); expect != g {
+			t.Errorf("call %d: unexpected body: expected %q, got %q", i+1, expect, g)
+		}
+	}
+}
+
+func TestMockTransportResponseAlternateBodyForkAndNormalize(t *testing.T) {
+	base := NewTransport(
+		New("http://example.com").
+			ResponseAlternateBody(200, "a  \n", "b"),
+	)
+	base.NormalizeResponseBodies()
+	get := func(m *MockTransport) string {
+		res := lo.Must1((&http.Client{Transport: m}).Get("http://example.com/flaky"))
+		return string(lo.Must1(io.ReadAll(res.Body)))
+	}
+
+	fork := base.Fork()
+	if e, g := "a", get(fork); e != g {
+		t.Errorf("unexpected fork body: expected %q, got %q", e, g)
+	}
+	// The fork's request does not advance the parent's alternation
+	if e, g := "a", get(base); e != g {
+		t.Errorf("unexpected parent body: expected %q, got %q", e, g)
+	}
+	if e, g := "b", get(fork); e != g {
+		t.Errorf("unexpected fork body: expected %q, got %q", e, g)
+	}
+}
+
+func TestMockTransportRequestTarget(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").Method(http.MethodOptions).RequestTarget("*").
+			ResponseSimple(204, ""),
+		New("http://example.com").Method(http.MethodOptions).RequestTarget("/users").
+			ResponseSimple(200, ""),
+	)
+	client := http.Client{Transport: mockTransport}
+
+	asterisk := lo.Must1(http.NewRequest("OPTIONS", "http://example.com", nil))
+	asterisk.URL.Opaque = "*"
+	for _, spec := range []struct {
+		Request *http.Request
+		Status  int
+	}{
+		{Request: lo.Must1(http.NewRequest("OPTIONS", "http://example.com/users", nil)), Status: 200},
+		{Request: asterisk, Status: 204},
+	} {
+		res := lo.Must1(client.Do(spec.Request))
+		if e, g := spec.Status, res.StatusCode; e != g {
+			t.Errorf("unexpected status for %s: expected %d, got %d", spec.Request.URL.RequestURI(), e, g)
+		}
+	}
+}
+
+func TestMockTransportDetachAfter(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").Get("/status").Name("warmup").DetachAfter(2).
+			ResponseSimple(503, "warming up").Times(3),
+		New("http://example.com").
+			AlwaysResponseSimple(200, "ready"),
+	)
+	client := http.Client{Transport: mockTransport}
+
+	for i, expect := range []string{"warming up", "warming up", "ready", "ready"} {
+		res := lo.Must1(client.Get("http://example.com/status"))
+		if g := string(lo.Must1(io.ReadAll(res.Body))); expect != g {
+			t.Errorf("call %d: unexpected body: expected %s, got %s", i+1, expect, g)
+		}
+	}
+	// The third warm-up response is left in the detached queue, which does not block completion
+	if !mockTransport.Completed() {
+		t.Errorf("mockTransport is not empty")
+	}
+	if e, g := 0, mockTransport.RemainingFor("warmup"); e != g {
+		t.Errorf("unexpected remaining for detached queue: expected %d, got %d", e, g)
+	}
+}
+
+func TestMockTransportWithPassthrough(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "real "+r.URL.Path)
+	}))
+	defer srv.Close()
+	mockTransport := NewTransport(
+		New(srv.URL).Get("/mocked").
+			ResponseSimple(200, "mock"),
+	).WithPassthrough(srv.Client().Transport)
+	client := http.Client{Transport: mockTransport}
+
+	for _, spec := range []struct {
+		Path string
+		Body string
+	}{
+		{Path: "/mocked", Body: "mock"},
+		{Path: "/other", Body: "real /other"},
+	} {
+		res := lo.Must1(client.Get(srv.URL + spec.Path))
+		if e, g := spec.Body, string(lo.Must1(io.ReadAll(res.Body))); e != g {
+			t.Errorf("unexpected body for %s: expected %s, got %s", spec.Path, e, g)
+		}
+		_ = res.Body.Close()
+	}
+
+	expect := fmt.Sprintf("1: GET %[1]s/mocked\n2: GET %[1]s/other (passthrough)", srv.URL)
+	if diff := cmp.Diff(expect, mockTransport.RequestLogString()); diff != "" {
+		t.Errorf("unexpected request log: %s", diff)
+	}
+	if !mockTransport.Completed() {
+		t.Errorf("mockTransport is not empty")
+	}
+}
+
+func TestMockTransportAssertTranscript(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").Get("/users").
+			ResponseSimple(200, "users"),
+	)
+	client := http.Client{Transport: mockTransport}
+
+	_, _ = client.Get("http://example.com/users")
+	_, _ = client.Get("http://example.com/posts")
+	mockTransport.AssertTranscript(t, `1: GET http://example.com/users
+2: GET http://example.com/posts (not matched)`)
+
+	rec := &recordingTB{TB: t}
+	mockTransport.AssertTranscript(rec, "1: GET http://example.com/users")
+	if e, g := 1, len(rec.errors); e != g {
+		t.Fatalf("unexpected error count: expected %d, got %d", e, g)
+	}
+	if !strings.Contains(rec.errors[0], "2: GET http://example.com/posts (not matched)") {
+		t.Errorf("expected diff to show the extra request:\n%s", rec.errors[0])
+	}
+}
+
+func TestMockTransportVaryOn(t *testing.T) {
+	cases := map[string]string{"gzip": "gzipped", "br": "brotli", "": "identity"}
+	mockTransport := NewTransport(
+		New("http://example.com").VaryOn("Accept-Encoding").
+			ResponseVaried(200, cases).
+			ResponseVaried(200, cases).
+			ResponseVaried(200, cases),
+	)
+	client := http.Client{Transport: mockTransport}
+
+	for _, spec := range []struct {
+		AcceptEncoding string
+		Body           string
+	}{
+		{AcceptEncoding: "", Body: ""},
+		{AcceptEncoding: "br", Body: "brotli"},
+		{AcceptEncoding: "gzip", Body: "gzipped"},
+		{AcceptEncoding: "deflate", Body: "identity"},
+	} {
+		req := lo.Must1(http.NewRequest("GET", "http://example.com/asset", nil))
+		req.Header.Set("Accept-Encoding", spec.AcceptEncoding)
+		res, err := client.Do(req)
+		if spec.Body == "" {
+			if err == nil {
+				t.Errorf("expected request without Accept-Encoding not to match")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []string{res.Header.Get("Vary"), string(lo.Must1(io.ReadAll(res.Body)))}
+		if diff := cmp.Diff([]string{"Accept-Encoding", spec.Body}, got); diff != "" {
+			t.Errorf("unexpected response for %s: %s", spec.AcceptEncoding, diff)
+		}
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("expected ResponseVaried without VaryOn to panic")
+			}
+		}()
+		New("http://example.com").ResponseVaried(200, cases)
+	}()
+}
+
+func TestMockTransportResponseVariedNormalize(t *testing.T) {
+	mockTransport := NewTransport(
+		New("http://example.com").VaryOn("Accept-Language").
+			ResponseVaried(200, map[string]string{"en": "b  \n"}),
+	)
+	mockTransport.NormalizeResponseBodies()
+
+	req := lo.Must1(http.NewRequest("GET", "http://example.com/greeting", nil))
+	req.Header.Set("Accept-Language", "en")
+	res := lo.Must1(mockTransport.RoundTrip(req))
+	if e, g := "b", string(lo.Must1(io.ReadAll(res.Body))); e != g {
+		t.Errorf("unexpected body: expected %q, got %q", e, g)
+	}
+}
+
+func TestMockTransportRecorder(t *testing.T) {
+	binary := []byte{0xff, 0xfe, 0x00, 0x01}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/users":
+			w.Header().Set("Content-Type", "application/json")
+			if r.Method == http.MethodPost {
+				w.WriteHeader(http.StatusCreated)
+			}
+			_, _ = io.Copy(w, r.Body)
+		case "/avatar":
+			w.Header().Set("Content-Type", "image/png")
+			_, _ = w.Write(binary)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	type request struct {
+		Method string
+		Path   string
+		Body   string
+	}
+	type response struct {
+		Status      int
+		ContentType string
+		Body        []byte
+	}
+	specs := []struct {
+		Request  request
+		Response response
+	}{
+		{
+			Request:  request{Method: "POST", Path: "/users", Body: `{"name":"alice"}`},
+			Response: response{Status: 201, ContentType: "application/json", Body: []byte(`{"name":"alice"}`)},
+		},
+		{
+			Request:  request{Method: "POST", Path: "/users", Body: `{"name":"bob"}`},
+			Response: response{Status: 201, ContentType: "application/json", Body: []byte(`{"name":"bob"}`)},
+		},
+		{
+			Request:  request{Method: "GET", Path: "/avatar"},
+			Response: response{Status: 200, ContentType: "image/png", Body: binary},
+		},
+		{
+			Request:  request{Method: "GET", Path: "/missing"},
+			Response: response{Status: 404, ContentType: "text/plain; charset=utf-8", Body: []byte("404 page not found\n")},
+		},
+	}
+	send := func(client http.Client, r request) response {
+		req := lo.Must1(http.NewRequest(r.Method, server.URL+r.Path, strings.NewReader(r.Body)))
+		res := lo.Must1(client.Do(req))
+		defer res.Body.Close()
+		return response{Status: res.StatusCode, ContentType: res.Header.Get("Content-Type"), Body: lo.Must1(io.ReadAll(res.Body))}
+	}
+
+	path := filepath.Join(t.TempDir(), "cassette.json")
+	recorder := NewRecorder(path, nil)
+	for _, spec := range specs {
+		if diff := cmp.Diff(spec.Response, send(http.Client{Transport: recorder}, spec.Request)); diff != "" {
+			t.Errorf("unexpected recorded response for %s %s: %s", spec.Request.Method, spec.Request.Path, diff)
+		}
+	}
+	if err := recorder.Close(); err != nil {
+		t.Fatalf("failed to write cassette: %v", err)
+	}
+
+	replay, err := LoadCassette(path)
+	if err != nil {
+		t.Fatalf("failed to load cassette: %v", err)
+	}
+	// Replay in the reverse order to check that responses are matched by request, including the body
+	for i := len(specs) - 1; i >= 0; i-- {
+		spec := specs[i]
+		if diff := cmp.Diff(spec.Response, send(http.Client{Transport: replay}, spec.Request)); diff != "" {
+			t.Errorf("unexpected replayed response for %s %s: %s", spec.Request.Method, spec.Request.Path, diff)
+		}
+	}
+	if !replay.Completed() {
+		t.Errorf("replay is not empty")
+	}
+
+	if _, err := LoadCassette(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Errorf("expected an error for a missing cassette")
+	}
+
+	// Credentials are redacted, and the caller's request body is not replaced
+	path = filepath.Join(t.TempDir(), "redacted.json")
+	recorder = NewRecorder(path, nil)
+	req := lo.Must1(http.NewRequest("POST", server.URL+"/users", strings.NewReader(`{"name":"carol"}`)))
+	req.Header.Set("Authorization", "Bearer secret-token")
+	body := req.Body
+	res := lo.Must1(recorder.RoundTrip(req))
+	_ = res.Body.Close()
+	if req.Body != body {
+		t.Errorf("expected the request body not to be replaced")
+	}
+	if res.Request != req {
+		t.Errorf("expected the caller's request in the response")
+	}
+	lo.Must0(recorder.Close())
+	cassette := string(lo.Must1(os.ReadFile(path)))
+	if strings.Contains(cassette, "secret-token") || !strings.Contains(cassette, `"REDACTED"`) {
+		t.Errorf("expected Authorization to be redacted: %s", cassette)
+	}
+}
+
+func TestMockTransportPatchHeadOptions(t *testing.T) {
+	q := New("http://example.com")
+	for _, mockTransport := range []*MockTransport{
+		NewTransport(
+			q.Patch("/users/1").ResponseSimple(200, "patched"),
+			q.Head("/users/1").ResponseSimple(200, ""),
+			q.Options("/users/1").ResponseSimple(204, ""),
+		),
+		NewTransport().
+			Origin("http://example.com").
+			Patch("/users/1", func(q RoundTripQueue) RoundTripQueue { return q.ResponseSimple(200, "patched") }).
+			Head("/users/1", func(q RoundTripQueue) RoundTripQueue { return q.ResponseSimple(200, "") }).
+			Options("/users/1", func(q RoundTripQueue) RoundTripQueue { return q.ResponseSimple(204, "") }).
+			Done(),
+	} {
+		client := http.Client{Transport: mockTransport}
+
+		for _, spec := range []struct {
+			Method string
+			Status int
+			Body   string
+		}{
+			{Method: http.MethodOptions, Status: 204, Body: ""},
+			{Method: http.MethodHead, Status: 200, Body: ""},
+			{Method: http.MethodPatch, Status: 200, Body: "patched"},
+		} {
+			req := lo.Must1(http.NewRequest(spec.Method, "http://example.com/users/1", nil))
+			res := lo.Must1(client.Do(req))
+			if e, g := spec.Status, res.StatusCode; e != g {
+				t.Errorf("unexpected status for %s: expected %d, got %d", spec.Method, e, g)
+			}
+			if e, g := spec.Body, string(lo.Must1(io.ReadAll(res.Body))); e != g {
+				t.Errorf("unexpected body for %s: expected %q, got %q", spec.Method, e, g)
+			}
+		}
+		if !mockTransport.Completed() {
+			t.Errorf("mockTransport is not empty")
+		}
+		if _, err := client.Get("http://example.com/users/1"); err == nil {
+			t.Errorf("expected GET not to match")
+		}
+	}
+}
+
+func TestMockTransportResponseFromDir(t *testing.T) {
+	dir := t.TempDir()
+	lo.Must0(os.MkdirAll(filepath.Join(dir, "users"), 0o755))
+	lo.Must0(os.WriteFile(filepath.Join(dir, "index.json"), []byte(`{"root":true}`), 0o644))
+	lo.Must0(os.WriteFile(filepath.Join(dir, "users", "1.json"), []byte(`{"id":1}`), 0o644))
+	lo.Must0(os.WriteFile(filepath.Join(dir, "users", "index.json"), []byte(`[1]`), 0o644))
+	lo.Must0(os.WriteFile(filepath.Join(dir, "robots.txt"), []byte("ok"), 0o644))
+
+	mockTransport := NewTransport(ResponseFromDir("http://example.com", dir))
+	client := http.Client{Transport: mockTransport}
+
+	for _, spec := range []struct {
+		Path   string
+		Status int
+		Body   string
+	}{
+		{Path: "/", Status: 200, Body: `{"root":true}`},
+		{Path: "/users/1", Status: 200, Body: `{"id":1}`},
+		{Path: "/users/1?fields=id", Status: 200, Body: `{"id":1}`},
+		{Path: "/users/", Status: 200, Body: `[1]`},
+		{Path: "/users/1.json", Status: 200, Body: `{"id":1}`},
+		{Path: "/robots.txt", Status: 200, Body: "ok"},
+		{Path: "/users/2", Status: 404, Body: ""},
+		{Path: "/users", Status: 404, Body: ""},
+		{Path: "/../users/1", Status: 200, Body: `{"id":1}`},
+	} {
+		res := lo.Must1(client.Get("http://example.com" + spec.Path))
+		if e, g := spec.Status, res.StatusCode; e != g {
+			t.Errorf("unexpected status for %s: expected %d, got %d", spec.Path, e, g)
+		}
+		if e, g := spec.Body, string(lo.Must1(io.ReadAll(res.Body))); e != g {
+			t.Errorf("unexpected body for %s: expected %q, got %q", spec.Path, e, g)
+		}
+	}
+
+	res := lo.Must1(client.Get("http://example.com/users/1"))
+	if e, g := "application/json", res.Header.Get("Content-Type"); e != g {
+		t.Errorf("unexpected Content-Type: expected %s, got %s", e, g)
+	}
+	res = lo.Must1(client.Head("http://example.com/users/1"))
+	if b := lo.Must1(io.ReadAll(res.Body)); res.StatusCode != 200 || len(b) != 0 {
+		t.Errorf("unexpected HEAD response: %d %q", res.StatusCode, b)
+	}
+	if !mockTransport.Completed() {
+		t.Errorf("mockTransport is not empty")
+	}
+	if _, err := client.Post("http://example.com/users/1", "application/json", nil); err == nil {
+		t.Errorf("expected POST not to match")
+	}
+}
@@ -0,0 +1,53 @@
+// Package rtqproto provides protobuf responses and matchers for rtq queues.
+// It is a separate package so that rtq itself does not depend on protobuf.
+package rtqproto
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+
+	rtq "github.com/goro9/go-rtq"
+	"google.golang.org/protobuf/proto"
+)
+
+// Response returns a response func, for use with RoundTripQueue.ResponseFunc, serving msg marshaled with
+// proto.Marshal as "application/x-protobuf". A marshal error fails the round trip.
+//
+//	q.ResponseFunc(rtqproto.Response(200, msg))
+func Response(statusCode int, msg proto.Message) func(*http.Request) (*http.Response, error) {
+	return func(req *http.Request) (*http.Response, error) {
+		b, err := proto.Marshal(msg)
+		if err != nil {
+			return nil, err
+		}
+		return &http.Response{
+			StatusCode: statusCode,
+			Body:       io.NopCloser(bytes.NewReader(b)),
+			Header:     http.Header{"Content-Type": []string{"application/x-protobuf"}},
+			Request:    req,
+		}, nil
+	}
+}
+
+// Body returns a matcher, for use with RoundTripQueue.Matcher, that unmarshals the request body into a fresh
+// message of the same type as msg and compares it with proto.Equal. Bodies that do not unmarshal do not match.
+//
+//	q.Matcher(rtqproto.Body(msg))
+func Body(msg proto.Message) rtq.MatchFunc {
+	return func(req *http.Request) (bool, error) {
+		if req.Body == nil {
+			return false, nil
+		}
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			return false, err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		got := msg.ProtoReflect().New().Interface()
+		if err := proto.Unmarshal(body, got); err != nil {
+			return false, nil
+		}
+		return proto.Equal(got, msg), nil
+	}
+}
@@ -0,0 +1,55 @@
+package rtqproto
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"testing"
+
+	rtq "github.com/goro9/go-rtq"
+	"github.com/samber/lo"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestResponse(t *testing.T) {
+	mockTransport := rtq.NewTransport(
+		rtq.New("http://example.com").
+			ResponseFunc(Response(200, wrapperspb.String("hello"))),
+	)
+	client := http.Client{Transport: mockTransport}
+
+	res := lo.Must1(client.Get("http://example.com/sample"))
+	if e, g := "application/x-protobuf", res.Header.Get("Content-Type"); e != g {
+		t.Errorf("unexpected Content-Type: expected %s, got %s", e, g)
+	}
+	got := &wrapperspb.StringValue{}
+	if err := proto.Unmarshal(lo.Must1(io.ReadAll(res.Body)), got); err != nil {
+		t.Fatal(err)
+	}
+	if e, g := "hello", got.GetValue(); e != g {
+		t.Errorf("unexpected message: expected %s, got %s", e, g)
+	}
+}
+
+func TestBody(t *testing.T) {
+	mockTransport := rtq.NewTransport(
+		rtq.New("http://example.com").Matcher(Body(wrapperspb.String("hello"))).
+			ResponseSimple(200, "ok"),
+	)
+	client := http.Client{Transport: mockTransport}
+
+	for _, spec := range []struct {
+		Body  []byte
+		Match bool
+	}{
+		{Body: lo.Must1(proto.Marshal(wrapperspb.String("bye"))), Match: false},
+		{Body: []byte{0xff}, Match: false},
+		{Body: lo.Must1(proto.Marshal(wrapperspb.String("hello"))), Match: true},
+	} {
+		_, err := client.Post("http://example.com/sample", "application/x-protobuf", bytes.NewReader(spec.Body))
+		if e, g := spec.Match, err == nil; e != g {
+			t.Errorf("unexpected match for %x: expected %t, got %t", spec.Body, e, g)
+		}
+	}
+}